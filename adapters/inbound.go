@@ -0,0 +1,419 @@
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/psyche/types"
+)
+
+// Inbound normalizes the event payload of a chat platform into RecvMsg
+type Inbound interface {
+	Name() string
+	Decode(*http.Request) ([]*types.RecvMsg, error)
+}
+
+// Name of the inbound adapter mapping arbitrary JSON using map.* query options
+const Generic = "generic"
+
+// ErrChallenge is returned when the platform expects the challenge echoed back instead of a message
+type ErrChallenge struct {
+	Challenge string
+}
+
+func (e ErrChallenge) Error() string {
+	return "inbound challenge " + e.Challenge
+}
+
+var inbounds = map[string]Inbound{
+	Botler:     botlerInbound{},
+	Slack:      slackInbound{},
+	Mattermost: mattermostInbound{},
+	Matrix:     matrixInbound{},
+	Generic:    genericInbound{},
+}
+
+// GetInbound returns the adapter registered with name, falling back to botler
+func GetInbound(name string) Inbound {
+	if i, ok := inbounds[strings.ToLower(name)]; ok {
+		return i
+	}
+
+	return inbounds[Botler]
+}
+
+// botlerInbound decodes the native botler payload
+type botlerInbound struct{}
+
+func (botlerInbound) Name() string {
+	return Botler
+}
+
+func (botlerInbound) Decode(req *http.Request) ([]*types.RecvMsg, error) {
+	rmsg, err := types.NewRecvMsg(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*types.RecvMsg{rmsg}, nil
+}
+
+// slackInbound decodes Slack Events API callbacks for message events
+type slackInbound struct{}
+
+type slackEnvelope struct {
+	Type      string          `json:"type"`
+	Challenge string          `json:"challenge"`
+	TeamID    string          `json:"team_id"`
+	Event     json.RawMessage `json:"event"`
+}
+
+type slackEvent struct {
+	Type     string `json:"type"`
+	Subtype  string `json:"subtype"`
+	Channel  string `json:"channel"`
+	User     string `json:"user"`
+	BotID    string `json:"bot_id"`
+	Text     string `json:"text"`
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+	Files    []struct {
+		Name string `json:"name"`
+		URL  string `json:"url_private"`
+	} `json:"files"`
+
+	// Edited message for message_changed, ts of the removed message for message_deleted
+	Message   *slackEvent `json:"message"`
+	DeletedTS string      `json:"deleted_ts"`
+
+	// Reacted message for reaction_added and reaction_removed
+	Item *struct {
+		Type    string `json:"type"`
+		Channel string `json:"channel"`
+		TS      string `json:"ts"`
+	} `json:"item"`
+}
+
+// Slack encodes user mentions as <@U123> or <@U123|name>
+var slackMentionRx = regexp.MustCompile(`<@([A-Z0-9]+)(\|[^>]*)?>`)
+
+func (slackInbound) Name() string {
+	return Slack
+}
+
+func (slackInbound) Decode(req *http.Request) ([]*types.RecvMsg, error) {
+	var env slackEnvelope
+	if err := json.NewDecoder(req.Body).Decode(&env); err != nil {
+		return nil, types.ErrInbound{Err: err}
+	}
+
+	switch env.Type {
+	case "url_verification":
+		return nil, ErrChallenge{env.Challenge}
+	case "event_callback":
+	default:
+		return nil, nil
+	}
+
+	var ev slackEvent
+	if err := json.Unmarshal(env.Event, &ev); err != nil {
+		return nil, types.ErrInbound{Err: err}
+	}
+
+	switch ev.Type {
+	case "message":
+	case "reaction_added", "reaction_removed":
+		return slackReaction(env.TeamID, &ev), nil
+	default:
+		return nil, nil
+	}
+
+	context := env.TeamID + ":" + ev.Channel
+
+	// Only plain messages from users and bots, edits and deletes, joins and others are notified as subtypes
+	switch ev.Subtype {
+	case "", "bot_message":
+		return []*types.RecvMsg{slackMessage(context, &ev)}, nil
+	case "message_changed":
+		if ev.Message == nil {
+			return nil, nil
+		}
+		rmsg := slackMessage(context, ev.Message)
+		rmsg.Event = types.EventEdit
+		return []*types.RecvMsg{rmsg}, nil
+	case "message_deleted":
+		rmsg := &types.RecvMsg{ID: ev.DeletedTS, Event: types.EventDelete, Context: context}
+		return []*types.RecvMsg{rmsg}, nil
+	}
+
+	return nil, nil
+}
+
+// slackReaction notifies reactions to messages, reactions to files are not indexed
+func slackReaction(teamId string, ev *slackEvent) []*types.RecvMsg {
+	if ev.Item == nil || ev.Item.Type != "message" {
+		return nil
+	}
+
+	rmsg := &types.RecvMsg{ID: ev.Item.TS, Event: types.EventReaction, Context: teamId + ":" + ev.Item.Channel}
+	if ev.Type == "reaction_removed" {
+		rmsg.Event = types.EventUnreaction
+	}
+	rmsg.Sender.ID = ev.User
+
+	return []*types.RecvMsg{rmsg}
+}
+
+func slackMessage(context string, ev *slackEvent) *types.RecvMsg {
+	rmsg := &types.RecvMsg{Message: ev.Text, Context: context}
+	rmsg.ID = ev.TS
+	rmsg.Timestamp = parseEpoch(ev.TS, time.Second)
+	rmsg.Sender.ID = ev.User
+	rmsg.Sender.Bot = len(ev.BotID) > 0
+	if len(rmsg.Sender.ID) == 0 {
+		rmsg.Sender.ID = ev.BotID
+	}
+
+	// Replies carry the ts of the parent, the parent carries its own ts as thread_ts
+	if len(ev.ThreadTS) > 0 && ev.ThreadTS != ev.TS {
+		rmsg.ThreadID = ev.ThreadTS
+	}
+
+	for _, m := range slackMentionRx.FindAllStringSubmatch(ev.Text, -1) {
+		rmsg.Mentions = append(rmsg.Mentions, m[1])
+	}
+
+	for _, f := range ev.Files {
+		rmsg.Attachments = append(rmsg.Attachments, types.Attachment{Name: f.Name, URL: f.URL})
+	}
+
+	return rmsg
+}
+
+// mattermostInbound decodes Mattermost outgoing webhooks sent as form or JSON
+type mattermostInbound struct{}
+
+type mattermostPost struct {
+	TeamID    string      `json:"team_id"`
+	ChannelID string      `json:"channel_id"`
+	UserID    string      `json:"user_id"`
+	UserName  string      `json:"user_name"`
+	PostID    string      `json:"post_id"`
+	Timestamp json.Number `json:"timestamp"`
+	Text      string      `json:"text"`
+}
+
+func (mattermostInbound) Name() string {
+	return Mattermost
+}
+
+func (mattermostInbound) Decode(req *http.Request) ([]*types.RecvMsg, error) {
+	var post mattermostPost
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(req.Body).Decode(&post); err != nil {
+			return nil, types.ErrInbound{Err: err}
+		}
+	} else {
+		if err := req.ParseForm(); err != nil {
+			return nil, types.ErrInbound{Err: err}
+		}
+		post = mattermostPost{
+			TeamID:    req.PostForm.Get("team_id"),
+			ChannelID: req.PostForm.Get("channel_id"),
+			UserID:    req.PostForm.Get("user_id"),
+			UserName:  req.PostForm.Get("user_name"),
+			PostID:    req.PostForm.Get("post_id"),
+			Timestamp: json.Number(req.PostForm.Get("timestamp")),
+			Text:      req.PostForm.Get("text"),
+		}
+	}
+
+	rmsg := &types.RecvMsg{Message: post.Text, Context: post.TeamID + ":" + post.ChannelID}
+	rmsg.ID = post.PostID
+	rmsg.Timestamp = parseEpoch(post.Timestamp.String(), time.Millisecond)
+	rmsg.Sender.ID = post.UserID
+	rmsg.Sender.Name = post.UserName
+
+	return []*types.RecvMsg{rmsg}, nil
+}
+
+// matrixInbound decodes Matrix application service transactions
+type matrixInbound struct{}
+
+type matrixTransaction struct {
+	Events []struct {
+		Type      string `json:"type"`
+		EventID   string `json:"event_id"`
+		RoomID    string `json:"room_id"`
+		Sender    string `json:"sender"`
+		Timestamp int64  `json:"origin_server_ts"`
+		Redacts   string `json:"redacts"`
+		Content   struct {
+			MsgType    string `json:"msgtype"`
+			Body       string `json:"body"`
+			NewContent struct {
+				Body string `json:"body"`
+			} `json:"m.new_content"`
+			RelatesTo struct {
+				RelType string `json:"rel_type"`
+				EventID string `json:"event_id"`
+			} `json:"m.relates_to"`
+			Mentions struct {
+				UserIDs []string `json:"user_ids"`
+			} `json:"m.mentions"`
+		} `json:"content"`
+	} `json:"events"`
+}
+
+func (matrixInbound) Name() string {
+	return Matrix
+}
+
+func (matrixInbound) Decode(req *http.Request) ([]*types.RecvMsg, error) {
+	var txn matrixTransaction
+	if err := json.NewDecoder(req.Body).Decode(&txn); err != nil {
+		return nil, types.ErrInbound{Err: err}
+	}
+
+	var msgs []*types.RecvMsg
+	for _, ev := range txn.Events {
+		// Room IDs are !opaque:homeserver, the homeserver scopes the room like a userbase
+		server := ev.RoomID
+		if i := strings.LastIndex(ev.RoomID, ":"); i >= 0 {
+			server = ev.RoomID[i+1:]
+		}
+		context := server + ":" + ev.RoomID
+
+		if ev.Type == "m.room.redaction" && len(ev.Redacts) > 0 {
+			msgs = append(msgs, &types.RecvMsg{ID: ev.Redacts, Event: types.EventDelete, Context: context})
+			continue
+		}
+
+		if ev.Type != "m.room.message" || (ev.Content.MsgType != "m.text" && ev.Content.MsgType != "m.notice") {
+			continue
+		}
+
+		rmsg := &types.RecvMsg{Message: ev.Content.Body, Context: context}
+		rmsg.ID = ev.EventID
+
+		// Edits replace the content of the original event
+		if ev.Content.RelatesTo.RelType == "m.replace" {
+			rmsg.ID = ev.Content.RelatesTo.EventID
+			rmsg.Event = types.EventEdit
+			rmsg.Message = ev.Content.NewContent.Body
+		}
+
+		rmsg.Sender.ID = ev.Sender
+		rmsg.Mentions = ev.Content.Mentions.UserIDs
+		if ev.Timestamp > 0 {
+			rmsg.Timestamp = time.Unix(0, ev.Timestamp*int64(time.Millisecond))
+		}
+		if ev.Content.RelatesTo.RelType == "m.thread" {
+			rmsg.ThreadID = ev.Content.RelatesTo.EventID
+		}
+		if len(rmsg.ID) > 0 {
+			rmsg.Permalink = "https://matrix.to/#/" + ev.RoomID + "/" + rmsg.ID
+		}
+		msgs = append(msgs, rmsg)
+	}
+
+	return msgs, nil
+}
+
+// genericInbound decodes arbitrary JSON with dotted paths given as map.<field> query options.
+// Context is mapped directly with map.context or composed from map.userbase and map.room.
+type genericInbound struct{}
+
+func (genericInbound) Name() string {
+	return Generic
+}
+
+func (genericInbound) Decode(req *http.Request) ([]*types.RecvMsg, error) {
+	var doc interface{}
+	if err := json.NewDecoder(req.Body).Decode(&doc); err != nil {
+		return nil, types.ErrInbound{Err: err}
+	}
+
+	q := req.URL.Query()
+	if len(q.Get("map.message")) == 0 {
+		return nil, types.ErrInbound{Err: fmt.Errorf("missing map.message for generic inbound")}
+	}
+
+	rmsg := &types.RecvMsg{}
+	rmsg.ID = lookupPath(doc, q.Get("map.id"))
+	rmsg.Event = lookupPath(doc, q.Get("map.event"))
+	rmsg.Message = lookupPath(doc, q.Get("map.message"))
+	rmsg.ThreadID = lookupPath(doc, q.Get("map.thread"))
+	rmsg.Permalink = lookupPath(doc, q.Get("map.permalink"))
+	rmsg.Sender.ID = lookupPath(doc, q.Get("map.sender"))
+	rmsg.Sender.Name = lookupPath(doc, q.Get("map.name"))
+	rmsg.Sender.Bot = lookupPath(doc, q.Get("map.bot")) == "true"
+
+	// Timestamps are accepted as RFC3339 or seconds since epoch
+	if ts := lookupPath(doc, q.Get("map.timestamp")); len(ts) > 0 {
+		if t, err := time.Parse(time.RFC3339, ts); err == nil {
+			rmsg.Timestamp = t
+		} else {
+			rmsg.Timestamp = parseEpoch(ts, time.Second)
+		}
+	}
+
+	if p := q.Get("map.context"); len(p) > 0 {
+		rmsg.Context = lookupPath(doc, p)
+	} else {
+		rmsg.Context = lookupPath(doc, q.Get("map.userbase")) + ":" + lookupPath(doc, q.Get("map.room"))
+	}
+
+	return []*types.RecvMsg{rmsg}, nil
+}
+
+// parseEpoch converts a decimal epoch in given unit to time, zero time if it cannot be parsed
+func parseEpoch(epoch string, unit time.Duration) time.Time {
+	f, err := strconv.ParseFloat(epoch, 64)
+	if err != nil || f <= 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(f*float64(unit)))
+}
+
+// lookupPath walks a decoded JSON document along a dotted path, array elements are addressed by index
+func lookupPath(doc interface{}, path string) string {
+	if len(path) == 0 {
+		return ""
+	}
+
+	cur := doc
+	for _, k := range strings.Split(path, ".") {
+		switch v := cur.(type) {
+		case map[string]interface{}:
+			cur = v[k]
+		case []interface{}:
+			var i int
+			if _, err := fmt.Sscanf(k, "%d", &i); err != nil || i < 0 || i >= len(v) {
+				return ""
+			}
+			cur = v[i]
+		default:
+			return ""
+		}
+	}
+
+	switch v := cur.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+
+	b, _ := json.Marshal(cur)
+	return string(b)
+}
@@ -0,0 +1,127 @@
+package adapters
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"bitbucket.org/psyche/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlackInbound(t *testing.T) {
+	req := httptest.NewRequest("POST", "/indexer?inbound=slack", strings.NewReader(`{"type":"url_verification","challenge":"3eZbrw1a"}`))
+	_, err := GetInbound(Slack).Decode(req)
+	require.Equal(t, ErrChallenge{"3eZbrw1a"}, err)
+
+	req = httptest.NewRequest("POST", "/indexer?inbound=slack", strings.NewReader(`{"type":"event_callback","team_id":"T1","event":{"type":"message","channel":"C1","user":"U1","text":"#gocql timeout <@U2|dk>","ts":"1355517523.000005","thread_ts":"1355517500.000001"}}`))
+	msgs, err := GetInbound(Slack).Decode(req)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "T1:C1", msgs[0].Context)
+	require.Equal(t, "U1", msgs[0].Sender.ID)
+	require.Equal(t, "1355517523.000005", msgs[0].ID)
+	require.Equal(t, int64(1355517523), msgs[0].Timestamp.Unix())
+	require.Equal(t, "1355517500.000001", msgs[0].ThreadID)
+	require.Equal(t, []string{"U2"}, msgs[0].Mentions)
+
+	req = httptest.NewRequest("POST", "/indexer?inbound=slack", strings.NewReader(`{"type":"event_callback","team_id":"T1","event":{"type":"message","subtype":"bot_message","bot_id":"B1","text":"#bot"}}`))
+	msgs, err = GetInbound(Slack).Decode(req)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.True(t, msgs[0].Sender.Bot)
+	require.Equal(t, "B1", msgs[0].Sender.ID)
+
+	req = httptest.NewRequest("POST", "/indexer?inbound=slack", strings.NewReader(`{"type":"event_callback","team_id":"T1","event":{"type":"message","subtype":"channel_join","user":"U1"}}`))
+	msgs, err = GetInbound(Slack).Decode(req)
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+}
+
+func TestSlackEditDelete(t *testing.T) {
+	req := httptest.NewRequest("POST", "/indexer?inbound=slack", strings.NewReader(`{"type":"event_callback","team_id":"T1","event":{"type":"message","subtype":"message_changed","channel":"C1","message":{"type":"message","user":"U1","text":"#gocql fixed","ts":"1355517523.000005"}}}`))
+	msgs, err := GetInbound(Slack).Decode(req)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, types.EventEdit, msgs[0].Event)
+	require.Equal(t, "1355517523.000005", msgs[0].ID)
+	require.Equal(t, "#gocql fixed", msgs[0].Message)
+
+	req = httptest.NewRequest("POST", "/indexer?inbound=slack", strings.NewReader(`{"type":"event_callback","team_id":"T1","event":{"type":"message","subtype":"message_deleted","channel":"C1","deleted_ts":"1355517523.000005"}}`))
+	msgs, err = GetInbound(Slack).Decode(req)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, types.EventDelete, msgs[0].Event)
+	require.Equal(t, "T1:C1", msgs[0].Context)
+}
+
+func TestSlackReaction(t *testing.T) {
+	req := httptest.NewRequest("POST", "/indexer?inbound=slack", strings.NewReader(`{"type":"event_callback","team_id":"T1","event":{"type":"reaction_added","user":"U2","reaction":"thumbsup","item":{"type":"message","channel":"C1","ts":"1355517523.000005"}}}`))
+	msgs, err := GetInbound(Slack).Decode(req)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, types.EventReaction, msgs[0].Event)
+	require.Equal(t, "1355517523.000005", msgs[0].ID)
+	require.Equal(t, "T1:C1", msgs[0].Context)
+
+	req = httptest.NewRequest("POST", "/indexer?inbound=slack", strings.NewReader(`{"type":"event_callback","team_id":"T1","event":{"type":"reaction_removed","user":"U2","reaction":"thumbsup","item":{"type":"message","channel":"C1","ts":"1355517523.000005"}}}`))
+	msgs, err = GetInbound(Slack).Decode(req)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, types.EventUnreaction, msgs[0].Event)
+
+	req = httptest.NewRequest("POST", "/indexer?inbound=slack", strings.NewReader(`{"type":"event_callback","team_id":"T1","event":{"type":"reaction_added","user":"U2","reaction":"thumbsup","item":{"type":"file","file":"F1"}}}`))
+	msgs, err = GetInbound(Slack).Decode(req)
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+}
+
+func TestMattermostInbound(t *testing.T) {
+	form := url.Values{"team_id": {"team"}, "channel_id": {"chan"}, "user_id": {"user"}, "text": {"#deploy done"}}
+	req := httptest.NewRequest("POST", "/indexer?inbound=mattermost", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	msgs, err := GetInbound(Mattermost).Decode(req)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "team:chan", msgs[0].Context)
+	require.Equal(t, "user", msgs[0].Sender.ID)
+}
+
+func TestMatrixInbound(t *testing.T) {
+	const txn = `{"events":[
+		{"type":"m.room.message","event_id":"$ev1","room_id":"!abc:acme.org","sender":"@dk:acme.org","origin_server_ts":1432735824653,"content":{"msgtype":"m.text","body":"#matrix works"}},
+		{"type":"m.room.member","room_id":"!abc:acme.org","sender":"@dk:acme.org","content":{}},
+		{"type":"m.room.message","event_id":"$ev2","room_id":"!abc:acme.org","sender":"@dk:acme.org","content":{"msgtype":"m.text","body":"* #matrix rocks","m.new_content":{"msgtype":"m.text","body":"#matrix rocks"},"m.relates_to":{"rel_type":"m.replace","event_id":"$ev1"}}},
+		{"type":"m.room.redaction","event_id":"$ev3","room_id":"!abc:acme.org","sender":"@dk:acme.org","redacts":"$ev1","content":{}}
+	]}`
+
+	msgs, err := GetInbound(Matrix).Decode(httptest.NewRequest("PUT", "/indexer?inbound=matrix", strings.NewReader(txn)))
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+	require.Equal(t, types.EventEdit, msgs[1].Event)
+	require.Equal(t, "$ev1", msgs[1].ID)
+	require.Equal(t, "#matrix rocks", msgs[1].Message)
+	require.Equal(t, types.EventDelete, msgs[2].Event)
+	require.Equal(t, "$ev1", msgs[2].ID)
+	require.Equal(t, "acme.org:!abc:acme.org", msgs[0].Context)
+	require.Equal(t, "@dk:acme.org", msgs[0].Sender.ID)
+	require.Equal(t, "https://matrix.to/#/!abc:acme.org/$ev1", msgs[0].Permalink)
+	require.Equal(t, int64(1432735824), msgs[0].Timestamp.Unix())
+}
+
+func TestGenericInbound(t *testing.T) {
+	const doc = `{"data":{"text":"#generic message","org":{"id":42},"rooms":["r1"],"author":"me"}}`
+	req := httptest.NewRequest("POST", "/indexer?inbound=generic&map.message=data.text&map.userbase=data.org.id&map.room=data.rooms.0&map.sender=data.author", strings.NewReader(doc))
+
+	msgs, err := GetInbound(Generic).Decode(req)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "#generic message", msgs[0].Message)
+	require.Equal(t, "42:r1", msgs[0].Context)
+	require.Equal(t, "me", msgs[0].Sender.ID)
+
+	_, err = GetInbound(Generic).Decode(httptest.NewRequest("POST", "/indexer?inbound=generic", strings.NewReader(doc)))
+	require.Error(t, err)
+}
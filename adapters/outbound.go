@@ -0,0 +1,181 @@
+package adapters
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"net/url"
+	"strings"
+
+	"bitbucket.org/psyche/types"
+)
+
+// Outbound renders a SendMsg into the incoming webhook payload of a chat platform
+type Outbound interface {
+	Name() string
+	Encode(*types.SendMsg) ([]byte, error)
+}
+
+// Names of supported outbound adapters, used as type= option with /register
+const (
+	Botler     = "botler"
+	Slack      = "slack"
+	Mattermost = "mattermost"
+	Teams      = "teams"
+	Discord    = "discord"
+	Matrix     = "matrix"
+)
+
+// Discord rejects webhook content longer than 2000 characters
+const discordMaxContent = 2000
+
+var outbounds = map[string]Outbound{
+	Botler:     botlerOutbound{},
+	Slack:      slackOutbound{},
+	Mattermost: mattermostOutbound{},
+	Teams:      teamsOutbound{},
+	Discord:    discordOutbound{},
+	Matrix:     matrixOutbound{},
+}
+
+// GetOutbound returns the adapter registered with name, falling back to botler
+func GetOutbound(name string) Outbound {
+	if o, ok := outbounds[strings.ToLower(name)]; ok {
+		return o
+	}
+
+	return outbounds[Botler]
+}
+
+// IsOutbound reports if name is a known outbound adapter
+func IsOutbound(name string) bool {
+	_, ok := outbounds[strings.ToLower(name)]
+	return ok
+}
+
+// DetectOutbound guesses the adapter for a webhook URL based on well known URL patterns
+func DetectOutbound(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return Botler
+	}
+
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case host == "hooks.slack.com":
+		return Slack
+	case (host == "discord.com" || host == "discordapp.com") && strings.HasPrefix(u.Path, "/api/webhooks/"):
+		return Discord
+	case host == "outlook.office.com" || strings.HasSuffix(host, ".webhook.office.com"):
+		return Teams
+	case strings.HasPrefix(u.Path, "/_matrix/hookshot/webhook/"):
+		return Matrix
+	case strings.HasPrefix(u.Path, "/hooks/"):
+		return Mattermost
+	}
+
+	return Botler
+}
+
+func encode(v interface{}) ([]byte, error) {
+	body := new(bytes.Buffer)
+	if err := json.NewEncoder(body).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return body.Bytes(), nil
+}
+
+// botlerOutbound posts SendMsg as is
+type botlerOutbound struct{}
+
+func (botlerOutbound) Name() string {
+	return Botler
+}
+
+func (botlerOutbound) Encode(smsg *types.SendMsg) ([]byte, error) {
+	return encode(smsg)
+}
+
+// slackOutbound renders Slack incoming webhook payload
+type slackOutbound struct{}
+
+func (slackOutbound) Name() string {
+	return Slack
+}
+
+func (slackOutbound) Encode(smsg *types.SendMsg) ([]byte, error) {
+	return encode(struct {
+		Text   string `json:"text"`
+		Mrkdwn bool   `json:"mrkdwn"`
+	}{smsg.Text, smsg.Format == "markdown"})
+}
+
+// mattermostOutbound renders Mattermost incoming webhook payload, text is always markdown
+type mattermostOutbound struct{}
+
+func (mattermostOutbound) Name() string {
+	return Mattermost
+}
+
+func (mattermostOutbound) Encode(smsg *types.SendMsg) ([]byte, error) {
+	return encode(struct {
+		Text string `json:"text"`
+	}{smsg.Text})
+}
+
+// teamsOutbound renders Microsoft Teams connector MessageCard payload
+type teamsOutbound struct{}
+
+func (teamsOutbound) Name() string {
+	return Teams
+}
+
+func (teamsOutbound) Encode(smsg *types.SendMsg) ([]byte, error) {
+	return encode(struct {
+		Type     string `json:"@type"`
+		Context  string `json:"@context"`
+		Summary  string `json:"summary"`
+		Text     string `json:"text"`
+		Markdown bool   `json:"markdown"`
+	}{"MessageCard", "http://schema.org/extensions", "psyche", smsg.Text, smsg.Format == "markdown"})
+}
+
+// discordOutbound renders Discord webhook payload truncating content to the accepted length
+type discordOutbound struct{}
+
+func (discordOutbound) Name() string {
+	return Discord
+}
+
+func (discordOutbound) Encode(smsg *types.SendMsg) ([]byte, error) {
+	content := []rune(smsg.Text)
+	if len(content) > discordMaxContent {
+		content = append(content[:discordMaxContent-1], '…')
+	}
+
+	return encode(struct {
+		Content string `json:"content"`
+	}{string(content)})
+}
+
+// matrixOutbound renders the payload of hookshot generic webhooks posting to a Matrix room.
+// The Matrix client-server API takes a PUT with an access token, it is not supported.
+type matrixOutbound struct{}
+
+func (matrixOutbound) Name() string {
+	return Matrix
+}
+
+func (matrixOutbound) Encode(smsg *types.SendMsg) ([]byte, error) {
+	// hookshot renders text as markdown unless html is given, plain text is kept as is
+	var formatted string
+	if smsg.Format != "markdown" {
+		formatted = strings.Replace(html.EscapeString(smsg.Text), "\n", "<br>", -1)
+	}
+
+	return encode(struct {
+		Text string `json:"text"`
+		HTML string `json:"html,omitempty"`
+	}{smsg.Text, formatted})
+}
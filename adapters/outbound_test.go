@@ -0,0 +1,126 @@
+package adapters
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"bitbucket.org/psyche/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectOutbound(t *testing.T) {
+	urls := map[string]string{
+		"https://hooks.slack.com/services/T000/B000/XXXX":              Slack,
+		"https://discord.com/api/webhooks/123/abc":                     Discord,
+		"https://outlook.office.com/webhook/abc/IncomingWebhook/def":   Teams,
+		"https://acme.webhook.office.com/webhookb2/abc":                Teams,
+		"https://chat.acme.com/hooks/xyz":                              Mattermost,
+		"https://matrix.acme.com/_matrix/hookshot/webhook/abc":         Matrix,
+		"https://matrix.acme.com/_matrix/client/v3/rooms/abc/send":     Botler,
+		"https://botnana.domain.dev.atlassian.io/message?secret=12345": Botler,
+		"::not a url": Botler,
+	}
+
+	for u, name := range urls {
+		require.Equal(t, name, DetectOutbound(u), u)
+	}
+
+	require.Equal(t, Botler, GetOutbound("unknown").Name())
+	require.True(t, IsOutbound("Slack"))
+	require.False(t, IsOutbound("irc"))
+}
+
+func TestOutboundPayloads(t *testing.T) {
+	// Each stand-in accepts only the fields its platform requires
+	standins := map[string]func(map[string]interface{}) bool{
+		Botler: func(p map[string]interface{}) bool {
+			return p["text"] == "hello #psyche" && p["format"] == "text"
+		},
+		Slack: func(p map[string]interface{}) bool {
+			return p["text"] == "hello #psyche"
+		},
+		Mattermost: func(p map[string]interface{}) bool {
+			return p["text"] == "hello #psyche"
+		},
+		Teams: func(p map[string]interface{}) bool {
+			return p["@type"] == "MessageCard" && p["text"] == "hello #psyche"
+		},
+		Discord: func(p map[string]interface{}) bool {
+			return p["content"] == "hello #psyche"
+		},
+		Matrix: func(p map[string]interface{}) bool {
+			return p["text"] == "hello #psyche"
+		},
+	}
+
+	for name, accept := range standins {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var p map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&p); err != nil || !accept(p) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		body, err := GetOutbound(name).Encode(types.NewSendMsg("hello #psyche"))
+		require.NoError(t, err)
+
+		resp, err := http.Post(srv.URL, "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode, name)
+
+		srv.Close()
+	}
+}
+
+func TestDiscordTruncate(t *testing.T) {
+	body, err := GetOutbound(Discord).Encode(types.NewSendMsg(strings.Repeat("x", 3*discordMaxContent)))
+	require.NoError(t, err)
+
+	var p struct {
+		Content string `json:"content"`
+	}
+	require.NoError(t, json.Unmarshal(body, &p))
+	require.Equal(t, discordMaxContent, len([]rune(p.Content)))
+}
+
+func TestMatrixHookshot(t *testing.T) {
+	var got map[string]string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_matrix/hookshot/webhook/abc", func(w http.ResponseWriter, req *http.Request) {
+		got = nil
+		if req.Method != http.MethodPost || json.NewDecoder(req.Body).Decode(&got) != nil || len(got["text"]) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	url := srv.URL + "/_matrix/hookshot/webhook/abc"
+	require.Equal(t, Matrix, DetectOutbound(url))
+
+	post := func(smsg *types.SendMsg) {
+		body, err := GetOutbound(DetectOutbound(url)).Encode(smsg)
+		require.NoError(t, err)
+
+		resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// Plain text is not rendered as markdown
+	post(types.NewSendMsg("1 < 2\n*not bold*"))
+	require.Equal(t, map[string]string{"text": "1 < 2\n*not bold*", "html": "1 &lt; 2<br>*not bold*"}, got)
+
+	post(&types.SendMsg{"**bold**", "markdown"})
+	require.Equal(t, map[string]string{"text": "**bold**"}, got)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/psyche/plugins"
+)
+
+// Admin commands invoked as: psyche <command> [flags] [args]
+var adminCommands = map[string]func(*sql.DB, []string) error{
+	"exclude":     adminExclude,
+	"retention":   adminRetention,
+	"expire":      adminExpire,
+	"forget-user": adminForgetUser,
+	"import":      adminImport,
+	"reindex":     adminReindex,
+}
+
+func runAdmin(dbh *sql.DB, args []string) error {
+	cmd, ok := adminCommands[args[0]]
+	if !ok {
+		var names []string
+		for n := range adminCommands {
+			names = append(names, n)
+		}
+		return fmt.Errorf("unknown command %s, expected one of %s", args[0], strings.Join(names, ", "))
+	}
+
+	if dbh == nil {
+		return errors.New("admin commands require PG_PSYCHE_URL")
+	}
+
+	return cmd(dbh, args[1:])
+}
+
+// psyche exclude [-userbase id] [-room id] add|include|remove|list [pattern...]
+func adminExclude(dbh *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("exclude", flag.ExitOnError)
+	userbase := fs.String("userbase", "", "userbase of the rules, all userbases if empty")
+	room := fs.String("room", "", "room of the rules, all rooms in the userbase if empty")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("usage: psyche exclude [-userbase id] [-room id] add|include|remove|list [pattern...]")
+	}
+
+	if err := plugins.InitExclusions(dbh); err != nil {
+		return err
+	}
+
+	patterns := fs.Args()[1:]
+	switch fs.Arg(0) {
+	case "add", plugins.ExcludeAction:
+		for _, p := range patterns {
+			if err := plugins.AddExclusion(dbh, *userbase, *room, p, plugins.ExcludeAction); err != nil {
+				return err
+			}
+		}
+	case plugins.IncludeAction:
+		for _, p := range patterns {
+			if err := plugins.AddExclusion(dbh, *userbase, *room, p, plugins.IncludeAction); err != nil {
+				return err
+			}
+		}
+	case "remove":
+		for _, p := range patterns {
+			if err := plugins.RemoveExclusion(dbh, *userbase, *room, p); err != nil {
+				return err
+			}
+		}
+	case "list":
+		rules, err := plugins.ListExclusions(dbh, *userbase, *room)
+		if err != nil {
+			return err
+		}
+		for _, r := range rules {
+			fmt.Fprintln(os.Stdout, r)
+		}
+	default:
+		return fmt.Errorf("unknown exclude command %s", fs.Arg(0))
+	}
+
+	return nil
+}
+
+// psyche retention -userbase id [-room id] [-mode all|keep-tagged] [-archive] days|off
+func adminRetention(dbh *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("retention", flag.ExitOnError)
+	userbase := fs.String("userbase", "", "userbase of the policy")
+	room := fs.String("room", "", "room of the policy, all rooms in the userbase if empty")
+	mode := fs.String("mode", plugins.RetainNone, "expire all messages or keep-tagged messages")
+	archive := fs.Bool("archive", false, "archive expired messages instead of deleting them")
+	fs.Parse(args)
+
+	if len(*userbase) == 0 || fs.NArg() != 1 {
+		return errors.New("usage: psyche retention -userbase id [-room id] [-mode all|keep-tagged] [-archive] days|off")
+	}
+
+	if err := plugins.InitRetention(dbh); err != nil {
+		return err
+	}
+
+	if fs.Arg(0) == "off" {
+		return plugins.RemoveRetention(dbh, *userbase, *room)
+	}
+
+	days, err := strconv.Atoi(fs.Arg(0))
+	if err != nil || days <= 0 {
+		return fmt.Errorf("invalid days %s", fs.Arg(0))
+	}
+
+	return plugins.SetRetention(dbh, *userbase, *room, days, *mode, *archive)
+}
+
+// psyche expire
+func adminExpire(dbh *sql.DB, args []string) error {
+	if err := plugins.InitRetention(dbh); err != nil {
+		return err
+	}
+
+	count, err := plugins.ExpireMessages(dbh)
+	fmt.Fprintf(os.Stdout, "expired %d messages\n", count)
+
+	return err
+}
+
+// psyche forget-user -userbase id user...
+func adminForgetUser(dbh *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("forget-user", flag.ExitOnError)
+	userbase := fs.String("userbase", "", "userbase of the users")
+	fs.Parse(args)
+
+	if len(*userbase) == 0 || fs.NArg() == 0 {
+		return errors.New("usage: psyche forget-user -userbase id user...")
+	}
+
+	if err := plugins.InitRetention(dbh); err != nil {
+		return err
+	}
+
+	for _, user := range fs.Args() {
+		count, err := plugins.ForgetUser(dbh, *userbase, user)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "removed %d messages of %s\n", count, user)
+	}
+
+	return nil
+}
+
+// initIndexer creates the indexer plugin along with the plugins whose tables it reads
+func initIndexer(dbh *sql.DB) (plugins.Psyches, error) {
+	ps := make(plugins.Psyches)
+	ps["alias"] = plugins.NewAliasPlugin(dbh, ps)
+	ps["ignore"] = plugins.NewIgnorePlugin(dbh, ps)
+	ps["exclude"] = plugins.NewExcludePlugin(dbh, ps)
+	ps["indexer"] = plugins.NewIndexerPlugin(dbh, ps)
+	for name, p := range ps {
+		if p == nil {
+			return nil, fmt.Errorf("failed to initialize %s plugin", name)
+		}
+	}
+
+	return ps, nil
+}
+
+// psyche import [-context userbase:room] [-workers n] [-disableHashCheck] file...
+func adminImport(dbh *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	context := fs.String("context", "", "userbase:room of records without a room")
+	workers := fs.Int("workers", 0, "messages indexed concurrently")
+	disableHashCheck := fs.Bool("disableHashCheck", false, "index messages without hash tags")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("usage: psyche import [-context userbase:room] [-workers n] [-disableHashCheck] file...")
+	}
+
+	ps, err := initIndexer(dbh)
+	if err != nil {
+		return err
+	}
+
+	opts := plugins.ImportOptions{Context: *context, Workers: *workers, DisableHashCheck: *disableHashCheck}
+	for _, name := range fs.Args() {
+		// "-" reads the export from stdin
+		f := os.Stdin
+		if name != "-" {
+			var err error
+			if f, err = os.Open(name); err != nil {
+				return err
+			}
+		}
+
+		stats, err := plugins.Import(ps["indexer"], f, opts, func(s plugins.ImportStats) {
+			fmt.Fprintf(os.Stderr, "%s: %d lines, %d indexed, %d duplicates, %d skipped, %d failed\n",
+				name, s.Lines, s.Indexed, s.Duplicates, s.Skipped, s.Failed)
+		})
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stdout, "imported %s: %d indexed, %d duplicates, %d skipped, %d failed\n",
+			name, stats.Indexed, stats.Duplicates, stats.Skipped, stats.Failed)
+	}
+
+	return nil
+}
+
+// psyche reindex [-userbase id] [-room id] [-since date] [-until date] start|run [id]|list|cancel id
+func adminReindex(dbh *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	userbase := fs.String("userbase", "", "userbase of the messages, all userbases if empty")
+	room := fs.String("room", "", "room of the messages, all rooms in the userbase if empty")
+	since := fs.String("since", "", "reindex messages sent on or after the date, YYYY-MM-DD")
+	until := fs.String("until", "", "reindex messages sent before the date, YYYY-MM-DD")
+	fs.Parse(args)
+
+	usage := errors.New("usage: psyche reindex [-userbase id] [-room id] [-since date] [-until date] start|run [id]|list|cancel id")
+	if fs.NArg() == 0 {
+		return usage
+	}
+
+	if _, err := initIndexer(dbh); err != nil {
+		return err
+	}
+
+	var id int64
+	if fs.NArg() > 1 {
+		var err error
+		if id, err = strconv.ParseInt(fs.Arg(1), 10, 64); err != nil {
+			return fmt.Errorf("invalid job %s", fs.Arg(1))
+		}
+	}
+
+	switch fs.Arg(0) {
+	case "start":
+		var window [2]*time.Time
+		for i, v := range []string{*since, *until} {
+			if len(v) == 0 {
+				continue
+			}
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				return fmt.Errorf("invalid date %s", v)
+			}
+			window[i] = &t
+		}
+
+		id, err := plugins.CreateReindexJob(dbh, *userbase, *room, window[0], window[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "queued reindex job %d\n", id)
+	case "run":
+		// Runs in the foreground, an interrupted job is resumed by the server or another run
+		j, err := plugins.RunReindexJob(dbh, id)
+		if j == nil && err == nil {
+			return errors.New("no pending or interrupted reindex job")
+		}
+		if j != nil {
+			fmt.Fprintln(os.Stdout, j)
+		}
+		return err
+	case "list":
+		jobs, err := plugins.ListReindexJobs(dbh)
+		if err != nil {
+			return err
+		}
+		for _, j := range jobs {
+			fmt.Fprintln(os.Stdout, j)
+		}
+	case "cancel":
+		if id == 0 {
+			return usage
+		}
+		return plugins.CancelReindexJob(dbh, id)
+	default:
+		return usage
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+// Package httpclient provides the shared client for outbound requests to chat rooms
+package httpclient
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"bitbucket.org/psyche/types"
+)
+
+// Config tunes the outbound client
+type Config struct {
+	// Time to establish a connection to the target
+	ConnectTimeout time.Duration
+
+	// Time to wait for the response headers after sending the request
+	ResponseTimeout time.Duration
+
+	// Idle and active connections kept per target host
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+
+	// Proxy URL for outbound requests, HTTP(S)_PROXY environment is used if empty
+	Proxy string
+
+	// Consecutive failures to a host before requests are rejected for BreakerCooldown
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// DefaultConfig returns the configuration used by Default
+func DefaultConfig() Config {
+	return Config{
+		ConnectTimeout:      5 * time.Second,
+		ResponseTimeout:     10 * time.Second,
+		MaxIdleConnsPerHost: 8,
+		MaxConnsPerHost:     32,
+		BreakerThreshold:    5,
+		BreakerCooldown:     30 * time.Second,
+	}
+}
+
+// Client posts outbound requests with timeouts and circuit breaking per target host
+type Client struct {
+	http     *http.Client
+	cfg      Config
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// Default is the client shared by all plugins, replaced at startup with tuned configuration
+var Default, _ = New(DefaultConfig())
+
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// New creates a client with given configuration
+func New(cfg Config) (*Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if len(cfg.Proxy) > 0 {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s with error %s", cfg.Proxy, err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           (&net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.ResponseTimeout,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	return &Client{
+		http:     &http.Client{Transport: transport, Timeout: cfg.ConnectTimeout + cfg.ResponseTimeout},
+		cfg:      cfg,
+		breakers: make(map[string]*breaker),
+	}, nil
+}
+
+// Do sends the request and discards the response, non-2xx responses are returned as ErrRelay
+func (c *Client) Do(req *http.Request) error {
+	host := req.URL.Host
+	if !c.allow(host) {
+		return types.ErrRelay{Err: types.ErrCircuitOpen{Host: host}}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.record(host, false)
+		return types.ErrRelay{Err: fmt.Errorf("http post to %s failed with error %s", req.URL, err)}
+	}
+	resp.Body.Close()
+
+	// Client errors are caused by the request, not by an unhealthy host
+	c.record(host, resp.StatusCode < http.StatusInternalServerError)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return types.ErrRelay{Err: types.ErrStatus{URL: req.URL.String(), StatusCode: resp.StatusCode, Status: resp.Status}}
+	}
+
+	return nil
+}
+
+// allow reports if requests to host are permitted, a single trial is let through after cooldown
+func (c *Client) allow(host string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.breakers[host]
+	if !ok || c.cfg.BreakerThreshold <= 0 || b.failures < c.cfg.BreakerThreshold {
+		return true
+	}
+
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+
+	// Half open, reject others until the trial request completes
+	b.openUntil = now.Add(c.cfg.BreakerCooldown)
+	return true
+}
+
+func (c *Client) record(host string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ok {
+		delete(c.breakers, host)
+		return
+	}
+
+	b, found := c.breakers[host]
+	if !found {
+		b = &breaker{}
+		c.breakers[host] = b
+	}
+
+	b.failures++
+	if b.failures >= c.cfg.BreakerThreshold {
+		b.openUntil = time.Now().Add(c.cfg.BreakerCooldown)
+	}
+}
@@ -0,0 +1,70 @@
+package httpclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"bitbucket.org/psyche/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	c, err := New(DefaultConfig())
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("POST", srv.URL, nil)
+	err = c.Do(req)
+	require.IsType(t, types.ErrRelay{}, err)
+	require.Equal(t, http.StatusNotFound, err.(types.ErrRelay).Err.(types.ErrStatus).StatusCode)
+}
+
+func TestBreaker(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	cfg := DefaultConfig()
+	cfg.BreakerThreshold = 2
+	cfg.BreakerCooldown = 50 * time.Millisecond
+	c, _ := New(cfg)
+
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("POST", srv.URL, nil)
+		c.Do(req)
+	}
+	require.Equal(t, 2, calls)
+
+	req, _ := http.NewRequest("POST", srv.URL, nil)
+	err := c.Do(req)
+	require.IsType(t, types.ErrCircuitOpen{}, err.(types.ErrRelay).Err)
+
+	// Trial request after cooldown
+	time.Sleep(60 * time.Millisecond)
+	req, _ = http.NewRequest("POST", srv.URL, nil)
+	c.Do(req)
+	require.Equal(t, 3, calls)
+}
+
+func TestTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	cfg := DefaultConfig()
+	cfg.ResponseTimeout = 50 * time.Millisecond
+	c, _ := New(cfg)
+
+	req, _ := http.NewRequest("POST", srv.URL, nil)
+	require.Error(t, c.Do(req))
+}
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"bitbucket.org/psyche/adapters"
+	"bitbucket.org/psyche/httpclient"
 	"bitbucket.org/psyche/plugins"
 	"bitbucket.org/psyche/types"
+	"bitbucket.org/psyche/utils"
 	_ "github.com/lib/pq"
 )
 
@@ -19,10 +28,229 @@ func healthcheckHandle(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte("ok\r\n"))
 }
 
+func statsHandle(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"indexer_skipped": plugins.SkipCounts(),
+	})
+}
+
+// adminAuthorized checks for PSYCHE_ADMIN_TOKEN as bearer token, admin endpoints are disabled without it
+func adminAuthorized(req *http.Request) bool {
+	token := os.Getenv("PSYCHE_ADMIN_TOKEN")
+	auth := []byte(req.Header.Get("Authorization"))
+
+	return len(token) > 0 && subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) == 1
+}
+
+// secretHandle returns the secret signing messages posted to the room in context, POST rotates it.
+// Requires PSYCHE_ADMIN_TOKEN as bearer token, secrets are never sent to rooms.
+func secretHandle(dbh *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !adminAuthorized(req) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if req.Method != http.MethodGet && req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		scope := strings.SplitN(req.URL.Query().Get("context"), ":", 2)
+		if len(scope) != 2 || len(scope[0]) == 0 || len(scope[1]) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("missing userbase:chatroom for context\r\n"))
+			return
+		}
+
+		secret, err := plugins.RoomSecret(dbh, scope[0], scope[1], req.Method == http.MethodPost)
+		if err != nil {
+			if _, ok := err.(types.ErrRegister); ok {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			w.Write([]byte(err.Error()))
+			w.Write([]byte("\r\n"))
+			return
+		}
+
+		// Deliveries are signed with the new or generated secret from now on
+		if p, ok := psyches["relay"]; ok {
+			p.Refresh()
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(secret + "\r\n"))
+	}
+}
+
+// importHandle indexes the NDJSON export in the request body and streams the progress as NDJSON.
+// Requires PSYCHE_ADMIN_TOKEN as bearer token, imports are disabled without it.
+func importHandle(w http.ResponseWriter, req *http.Request) {
+	if !adminAuthorized(req) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, ok := psyches["indexer"]
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	q := req.URL.Query()
+	opts := plugins.ImportOptions{Context: q.Get("context")}
+	opts.Workers, _ = strconv.Atoi(q.Get("workers"))
+	opts.DisableHashCheck, _ = strconv.ParseBool(q.Get("disableHashCheck"))
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	stats, err := plugins.Import(p, req.Body, opts, func(s plugins.ImportStats) {
+		enc.Encode(s)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+
+	// Final summary, progress lines share its fields
+	summary := struct {
+		plugins.ImportStats
+		Done  bool   `json:"done"`
+		Error string `json:"error,omitempty"`
+	}{ImportStats: stats, Done: true}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	enc.Encode(summary)
+}
+
+// apiSearchHandle returns the messages matching a search as JSON.
+// Requires PSYCHE_API_TOKEN as bearer token, the API is disabled without it.
+func apiSearchHandle(w http.ResponseWriter, req *http.Request) {
+	token := os.Getenv("PSYCHE_API_TOKEN")
+	auth := []byte(req.Header.Get("Authorization"))
+	if len(token) == 0 || subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, ok := psyches["search"]
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	fail := func(status int, err error) {
+		w.WriteHeader(status)
+		enc.Encode(map[string]string{"error": err.Error()})
+	}
+
+	q := req.URL.Query()
+	r := plugins.SearchRequest{
+		Context: q.Get("context"),
+		Text:    q.Get("q"),
+		Tags:    q["tag"],
+		All:     strings.EqualFold(q.Get("op"), "and"),
+		Has:     q["has"],
+		Tickets: q["ticket"],
+		Sender:  q.Get("sender"),
+	}
+
+	for _, h := range r.Has {
+		switch h {
+		case utils.HasLink, utils.HasCode, utils.HasTrace, utils.HasTicket:
+		default:
+			fail(http.StatusBadRequest, fmt.Errorf("invalid has %s", h))
+			return
+		}
+	}
+
+	var err error
+	if v := q.Get("limit"); len(v) > 0 {
+		if r.Limit, err = strconv.Atoi(v); err != nil || r.Limit < 0 {
+			fail(http.StatusBadRequest, fmt.Errorf("invalid limit %s", v))
+			return
+		}
+	}
+	if r.Ranking, err = utils.ParseRanking(q.Get("ranking"), plugins.SearchRanking); err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	if scope := strings.SplitN(r.Context, ":", 2); len(scope) != 2 || len(scope[0]) == 0 || len(scope[1]) == 0 {
+		fail(http.StatusBadRequest, fmt.Errorf("missing userbase:chatroom for context"))
+		return
+	}
+
+	format := q.Get("export")
+	if len(format) > 0 && !plugins.IsExportFormat(format) {
+		fail(http.StatusBadRequest, fmt.Errorf("unknown export format %s", format))
+		return
+	}
+
+	results, err := plugins.Search(p, r)
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(format) == 0 {
+		enc.Encode(results)
+		return
+	}
+
+	// Exports are downloaded as files, cut at the maximum size
+	var buff bytes.Buffer
+	count, err := plugins.WriteExport(&buff, format, "Search: "+r.Text, results.Hits, plugins.ExportMaxSize)
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+
+	contentType, ext := plugins.ExportContentType(format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=search."+ext)
+	w.Header().Set("X-Psyche-Truncated", strconv.FormatBool(results.Truncated || count < len(results.Hits)))
+	w.Write(buff.Bytes())
+}
+
+// exportsHandle serves the exports stored by search
+func exportsHandle(w http.ResponseWriter, req *http.Request) {
+	path, ok := plugins.ExportPath(strings.TrimPrefix(req.URL.Path, "/exports/"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	http.ServeFile(w, req, path)
+}
+
 func httpHandler(endpoint string) func(w http.ResponseWriter, req *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
-		msg, err := types.NewRecvMsg(req.Body)
+		// Payload format of the calling chat platform, botler by default
+		msgs, err := adapters.GetInbound(req.URL.Query().Get("inbound")).Decode(req)
 		if err != nil {
+			if c, ok := err.(adapters.ErrChallenge); ok {
+				w.Write([]byte(c.Challenge))
+				return
+			}
+
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(err.Error()))
 			w.Write([]byte("\r\n"))
@@ -34,19 +262,22 @@ func httpHandler(endpoint string) func(w http.ResponseWriter, req *http.Request)
 			return
 		}
 
-		_, err = p.Handle(req.URL, msg)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			w.Write([]byte("\r\n"))
+		for _, msg := range msgs {
+			_, err = p.Handle(req.URL, msg)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				w.Write([]byte("\r\n"))
 
-			if p, ok := psyches["relay"]; ok {
-				u := url.URL{}
-				u.Query().Add("source", msg.Context)
-				u.Query().Add("target", "error:error")
-				msg.Message = fmt.Sprintf("psyche request error: endpoint=%s, error=%s", endpoint, err)
+				if p, ok := psyches["relay"]; ok {
+					u := url.URL{}
+					u.Query().Add("source", msg.Context)
+					u.Query().Add("target", "error:error")
+					msg.Message = fmt.Sprintf("psyche request error: endpoint=%s, error=%s", endpoint, err)
 
-				p.Handle(&u, msg)
+					p.Handle(&u, msg)
+				}
+				return
 			}
 		}
 
@@ -59,6 +290,20 @@ func main() {
 	var dbh *sql.DB
 	http.HandleFunc("/healthcheck", healthcheckHandle)
 
+	// Outbound requests to rooms, proxy falls back to HTTPS_PROXY if PSYCHE_PROXY_URL is not set
+	cfg := httpclient.DefaultConfig()
+	if v, ok := os.LookupEnv("PSYCHE_PROXY_URL"); ok {
+		cfg.Proxy = v
+	}
+	if v, ok := os.LookupEnv("PSYCHE_HTTP_TIMEOUT"); ok {
+		if cfg.ResponseTimeout, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid PSYCHE_HTTP_TIMEOUT %s with error %s", v, err)
+		}
+	}
+	if httpclient.Default, err = httpclient.New(cfg); err != nil {
+		log.Fatalf("failed to initialize HTTP client with error %s", err)
+	}
+
 	// To run locally, run postgres and set the following env
 	// PG_PSYCHE_URL="postgres://postgres@localhost:5432/postgres?sslmode=disable"
 	if pgurl, ok := os.LookupEnv("PG_PSYCHE_URL"); ok {
@@ -69,16 +314,94 @@ func main() {
 		dbh.SetMaxOpenConns(50)
 	}
 
+	// Admin commands run against the DB and exit
+	if len(os.Args) > 1 {
+		if err = runAdmin(dbh, os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Plugins that require persistence
 	if dbh != nil {
 		psyches["register"] = plugins.NewRegisterPlugin(dbh, psyches)
 		http.HandleFunc("/register", httpHandler("register"))
+		http.HandleFunc("/secret", secretHandle(dbh))
 
 		psyches["indexer"] = plugins.NewIndexerPlugin(dbh, psyches)
 		http.HandleFunc("/indexer", httpHandler("indexer"))
+		http.HandleFunc("/import", importHandle)
 
+		// Resume interrupted and run queued reindex jobs
+		plugins.StartReindexer(dbh, time.Minute)
+
+		// Weights of search ranking, like tag=3,keyword=1,halflife=30,reactions=0.5
+		if v, ok := os.LookupEnv("PSYCHE_RANKING"); ok {
+			if plugins.SearchRanking, err = utils.ParseRanking(v, utils.DefaultRanking); err != nil {
+				log.Fatalf("invalid PSYCHE_RANKING %s with error %s", v, err)
+			}
+		}
 		psyches["search"] = plugins.NewSearchPlugin(dbh, psyches)
 		http.HandleFunc("/search", httpHandler("search"))
+		http.HandleFunc("/api/v1/search", apiSearchHandle)
+
+		// Exports of search results, stored in a local directory and linked from messages
+		plugins.ExportDir, plugins.ExportURL = os.Getenv("PSYCHE_EXPORT_DIR"), os.Getenv("PSYCHE_EXPORT_URL")
+		if v, ok := os.LookupEnv("PSYCHE_EXPORT_MAX_SIZE"); ok {
+			if plugins.ExportMaxSize, err = strconv.Atoi(v); err != nil || plugins.ExportMaxSize <= 0 {
+				log.Fatalf("invalid PSYCHE_EXPORT_MAX_SIZE %s", v)
+			}
+		}
+		if v, ok := os.LookupEnv("PSYCHE_EXPORT_MESSAGE_MAX_SIZE"); ok {
+			if plugins.ExportMessageMaxSize, err = strconv.Atoi(v); err != nil || plugins.ExportMessageMaxSize <= 0 {
+				log.Fatalf("invalid PSYCHE_EXPORT_MESSAGE_MAX_SIZE %s", v)
+			}
+		}
+		if len(plugins.ExportDir) > 0 {
+			if err = os.MkdirAll(plugins.ExportDir, 0700); err != nil {
+				log.Fatalf("failed to create PSYCHE_EXPORT_DIR %s with error %s", plugins.ExportDir, err)
+			}
+			http.HandleFunc("/exports/", exportsHandle)
+		}
+
+		psyches["similar"] = plugins.NewSimilarPlugin(dbh, psyches)
+		http.HandleFunc("/similar", httpHandler("similar"))
+
+		psyches["duplicates"] = plugins.NewDuplicatesPlugin(dbh, psyches)
+		http.HandleFunc("/duplicates", httpHandler("duplicates"))
+
+		psyches["saved"] = plugins.NewSavedPlugin(dbh, psyches)
+		http.HandleFunc("/saved", httpHandler("saved"))
+
+		psyches["alias"] = plugins.NewAliasPlugin(dbh, psyches)
+		http.HandleFunc("/alias", httpHandler("alias"))
+
+		psyches["ignore"] = plugins.NewIgnorePlugin(dbh, psyches)
+		http.HandleFunc("/ignore", httpHandler("ignore"))
+
+		psyches["exclude"] = plugins.NewExcludePlugin(dbh, psyches)
+		http.HandleFunc("/exclude", httpHandler("exclude"))
+
+		psyches["forget"] = plugins.NewForgetPlugin(dbh, psyches)
+		http.HandleFunc("/forget", httpHandler("forget"))
+
+		// Senders allowed to set retention of a whole userbase in chat, as userbase:user
+		for _, id := range strings.FieldsFunc(os.Getenv("PSYCHE_RETENTION_ADMINS"), func(c rune) bool { return c == ',' || c == ' ' }) {
+			plugins.RetentionAdmins[id] = true
+		}
+		psyches["retention"] = plugins.NewRetentionPlugin(dbh, psyches)
+		http.HandleFunc("/retention", httpHandler("retention"))
+
+		// Expire messages as per retention policies
+		interval := time.Hour
+		if v, ok := os.LookupEnv("PSYCHE_JANITOR_INTERVAL"); ok {
+			if interval, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("invalid PSYCHE_JANITOR_INTERVAL %s with error %s", v, err)
+			}
+		}
+		plugins.StartJanitor(dbh, interval)
+
+		http.HandleFunc("/stats", statsHandle)
 	}
 
 	psyches["relay"] = plugins.NewRelayPlugin(dbh, psyches)
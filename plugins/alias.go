@@ -0,0 +1,169 @@
+package plugins
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"bitbucket.org/psyche/types"
+	"bitbucket.org/psyche/utils"
+)
+
+type aliasPlugin struct {
+	db      types.DBH
+	plugins Psyches
+}
+
+// NewAliasPlugin creates an instance of alias plugin implementing Psyche interface
+func NewAliasPlugin(db *sql.DB, p Psyches) Psyche {
+	r := &aliasPlugin{types.DBH{db}, p}
+
+	_, err := r.db.Exec("CREATE TABLE IF NOT EXISTS aliases (userbase_id text, room_id text, alias text, canonical text, PRIMARY KEY (userbase_id, room_id, alias))")
+	if err != nil {
+		return nil
+	}
+
+	return r
+}
+
+// Handle manages the aliases of a room with the commands:
+//
+//	k8s=kubernetes [...]    add or update aliases
+//	remove k8s [...]        remove aliases
+//	list                    list aliases
+func (p *aliasPlugin) Handle(u *url.URL, rmsg *types.RecvMsg) (*types.SendMsg, error) {
+	// Context: userbaseID:chatroomID
+	scope := strings.SplitN(rmsg.Context, ":", 2)
+	if len(scope) != 2 {
+		return nil, types.ErrAlias{fmt.Errorf("missing userbase:chatroom for scope")}
+	}
+
+	val, ok := p.plugins["relay"]
+	if !ok {
+		return nil, types.ErrAlias{errors.New("failed to get relay plugin")}
+	}
+
+	relay, ok := val.(*relayPlugin)
+	if !ok {
+		return nil, types.ErrAlias{errors.New("failed to cast relay plugin interface")}
+	}
+
+	fields := strings.Fields(sanitizeInputRx.ReplaceAllString(rmsg.Message, "="))
+
+	var reply string
+	var err error
+	switch {
+	case len(fields) == 0 || strings.ToLower(fields[0]) == "list":
+		reply, err = p.list(scope[0], scope[1])
+	case strings.ToLower(fields[0]) == "remove" || strings.ToLower(fields[0]) == "unalias":
+		reply, err = p.remove(scope[0], scope[1], fields[1:])
+	default:
+		reply, err = p.add(scope[0], scope[1], fields)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, relay.RelayMsg(rmsg, u.Query().Get("target"), types.NewSendMsg(reply))
+}
+
+func (p *aliasPlugin) add(userbaseId, roomId string, fields []string) (string, error) {
+	var buff bytes.Buffer
+	for _, f := range fields {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		alias, canonical := normalizeAliasTerm(kv[0]), normalizeAliasTerm(kv[1])
+		if len(alias) == 0 || len(canonical) == 0 || alias == canonical {
+			continue
+		}
+
+		_, err := p.db.Exec("INSERT INTO aliases VALUES($1, $2, $3, $4) ON CONFLICT (userbase_id, room_id, alias) DO UPDATE SET canonical=$4",
+			userbaseId, roomId, alias, canonical)
+		if err != nil {
+			return "", err
+		}
+
+		buff.WriteString(fmt.Sprintf("\n#%s = #%s", alias, canonical))
+	}
+
+	if buff.Len() == 0 {
+		return "", types.ErrAlias{fmt.Errorf("missing alias=canonical in %s", strings.Join(fields, " "))}
+	}
+
+	return "aliases updated:" + buff.String(), nil
+}
+
+func (p *aliasPlugin) remove(userbaseId, roomId string, fields []string) (string, error) {
+	var aliases []string
+	for _, f := range fields {
+		if a := normalizeAliasTerm(f); len(a) > 0 {
+			aliases = append(aliases, a)
+		}
+	}
+
+	for _, a := range aliases {
+		_, err := p.db.Exec("DELETE FROM aliases WHERE userbase_id=$1 AND room_id=$2 AND alias=$3", userbaseId, roomId, a)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("removed %d aliases", len(aliases)), nil
+}
+
+func (p *aliasPlugin) list(userbaseId, roomId string) (string, error) {
+	aliases, err := loadAliases(p.db, userbaseId, roomId)
+	if err != nil {
+		return "", err
+	}
+
+	var buff bytes.Buffer
+	buff.WriteString(fmt.Sprintf("%d aliases in room:", len(aliases)))
+	for a, c := range aliases {
+		buff.WriteString(fmt.Sprintf("\n#%s = #%s", a, c))
+	}
+
+	return buff.String(), nil
+}
+
+func (p *aliasPlugin) Refresh() error {
+	return nil
+}
+
+// normalizeAliasTerm normalizes an alias like a hash tag in a search query
+func normalizeAliasTerm(term string) string {
+	t := utils.NormalizeTag(strings.TrimLeft(term, "#"))
+	if len(t) == 0 {
+		return ""
+	}
+
+	return t[0]
+}
+
+// loadAliases returns the aliases of a room
+func loadAliases(db types.DBH, userbaseId, roomId string) (utils.Aliases, error) {
+	rows, err := db.Query("SELECT alias, canonical FROM aliases WHERE userbase_id=$1 AND room_id=$2", userbaseId, roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := make(utils.Aliases)
+
+	var alias, canonical string
+	for rows.Next() {
+		if err = rows.Scan(&alias, &canonical); err != nil {
+			return nil, err
+		}
+		aliases[alias] = canonical
+	}
+
+	return aliases, rows.Err()
+}
@@ -0,0 +1,43 @@
+package plugins
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testDB connects to the postgres at PG_PSYCHE_TEST_URL in a schema of its own, dropped after the test.
+// Tests of plugins need a database, they are skipped without one.
+func testDB(t *testing.T) *sql.DB {
+	pgurl, ok := os.LookupEnv("PG_PSYCHE_TEST_URL")
+	if !ok {
+		t.Skip("PG_PSYCHE_TEST_URL not set")
+	}
+
+	admin, err := sql.Open("postgres", pgurl)
+	require.NoError(t, err)
+
+	schema := fmt.Sprintf("psyche_test_%d", time.Now().UnixNano())
+	_, err = admin.Exec("CREATE SCHEMA " + schema)
+	require.NoError(t, err)
+
+	sep := "?"
+	if strings.Contains(pgurl, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("postgres", pgurl+sep+"search_path="+schema)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		db.Close()
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	})
+
+	return db
+}
@@ -0,0 +1,160 @@
+package plugins
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/psyche/types"
+	"bitbucket.org/psyche/utils"
+)
+
+type duplicatesPlugin struct {
+	db      types.DBH
+	plugins Psyches
+}
+
+// Similarity of an earlier message for a question to be a duplicate, unless set for the room
+const defaultDuplicateThreshold = 0.6
+
+// Messages sent this recently are part of the same conversation rather than earlier discussions
+const duplicateMinAge = time.Minute
+
+// NewDuplicatesPlugin creates an instance of duplicate question plugin implementing Psyche interface
+func NewDuplicatesPlugin(db *sql.DB, p Psyches) Psyche {
+	r := &duplicatesPlugin{types.DBH{db}, p}
+
+	// Rooms listed have duplicate detection on
+	_, err := r.db.Exec("CREATE TABLE IF NOT EXISTS duplicate_detection (userbase_id text, room_id text, threshold float8, PRIMARY KEY (userbase_id, room_id))")
+	if err != nil {
+		return nil
+	}
+
+	return r
+}
+
+// Handle turns duplicate question detection of the room on with "on [threshold=0.6]" or off with "off"
+func (p *duplicatesPlugin) Handle(u *url.URL, rmsg *types.RecvMsg) (*types.SendMsg, error) {
+	// Context: userbaseID:chatroomID
+	scope := strings.SplitN(rmsg.Context, ":", 2)
+	if len(scope) != 2 {
+		return nil, types.ErrDuplicates{fmt.Errorf("missing userbase:chatroom for scope")}
+	}
+
+	val, ok := p.plugins["relay"]
+	if !ok {
+		return nil, types.ErrDuplicates{errors.New("failed to get relay plugin")}
+	}
+
+	relay, ok := val.(*relayPlugin)
+	if !ok {
+		return nil, types.ErrDuplicates{errors.New("failed to cast relay plugin interface")}
+	}
+
+	fields := strings.Fields(strings.ToLower(sanitizeInputRx.ReplaceAllString(rmsg.Message, "=")))
+	if len(fields) == 0 {
+		return nil, types.ErrDuplicates{errors.New("missing on or off")}
+	}
+
+	var reply string
+	switch fields[0] {
+	case "off":
+		if _, err := p.db.Exec("DELETE FROM duplicate_detection WHERE userbase_id=$1 AND room_id=$2", scope[0], scope[1]); err != nil {
+			return nil, err
+		}
+		reply = "duplicate questions are no longer answered"
+	case "on":
+		threshold := defaultDuplicateThreshold
+		for _, f := range fields[1:] {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 || kv[0] != "threshold" {
+				return nil, types.ErrDuplicates{fmt.Errorf("unknown option %s", f)}
+			}
+
+			v, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil || v <= 0 || v > 1 {
+				return nil, types.ErrDuplicates{fmt.Errorf("threshold %s must be between 0 and 1", kv[1])}
+			}
+			threshold = v
+		}
+
+		_, err := p.db.Exec("INSERT INTO duplicate_detection VALUES($1, $2, $3) ON CONFLICT (userbase_id, room_id) DO UPDATE SET threshold=$3",
+			scope[0], scope[1], threshold)
+		if err != nil {
+			return nil, err
+		}
+		reply = fmt.Sprintf("questions are answered with earlier messages at least %.0f%% similar", 100*threshold)
+	default:
+		return nil, types.ErrDuplicates{fmt.Errorf("unknown command %s, expected on or off", fields[0])}
+	}
+
+	return nil, relay.RelayMsg(rmsg, u.Query().Get("target"), types.NewSendMsg(reply))
+}
+
+func (p *duplicatesPlugin) Refresh() error {
+	return nil
+}
+
+// notifyDuplicates replies in the room to a new question with the most similar earlier message, in rooms with duplicate detection on.
+// Replies in threads are follow ups rather than new questions. Failures are logged, detection never fails indexing.
+func notifyDuplicates(db types.DBH, plugins Psyches, userbaseId, roomId string, rmsg *types.RecvMsg, d *utils.IndexData) {
+	if len(rmsg.ThreadID) > 0 || !utils.IsQuestion(rmsg.Message) {
+		return
+	}
+
+	var threshold float64
+	err := db.QueryRow("SELECT threshold FROM duplicate_detection WHERE userbase_id=$1 AND room_id=$2", userbaseId, roomId).Scan(&threshold)
+	if err != nil {
+		// Rooms without detection, or without the duplicates plugin
+		return
+	}
+
+	relay, ok := plugins["relay"].(*relayPlugin)
+	if !ok {
+		return
+	}
+	similar, ok := plugins["similar"].(*similarPlugin)
+	if !ok {
+		return
+	}
+
+	// Untagged questions are not indexed, their terms are extracted as for similar messages
+	if d == nil {
+		if d, err = similarTerms(db, userbaseId, roomId, rmsg.Message); err != nil || d == nil {
+			return
+		}
+	}
+
+	sent := rmsg.Timestamp
+	if sent.IsZero() {
+		sent = time.Now()
+	}
+
+	src := &similarSource{messageId: rmsg.ID, text: rmsg.Message, before: sent.Add(-duplicateMinAge)}
+	src.terms = append(append(append(src.terms, d.Tags...), d.Keywords...), d.Entities...)
+
+	hits, err := similar.find(userbaseId, roomId, src, 1, threshold)
+	if err != nil {
+		log.Printf("duplicate detection failed with error %s", err)
+		return
+	}
+	if len(hits) == 0 {
+		return
+	}
+
+	h := hits[0]
+	text := fmt.Sprintf("this was discussed on %s: %s\n", h.ctime.Format("2006-01-02"),
+		utils.Snippet(h.message, src.terms, snippetLength, func(w string) string { return w }))
+	if len(h.permalink) > 0 {
+		text += h.permalink + "\n"
+	}
+
+	if err = relay.RelayMsg(rmsg, "", types.NewSendMsg(text)); err != nil {
+		log.Printf("duplicate reply in %s failed with error %s", rmsg.Context, err)
+	}
+}
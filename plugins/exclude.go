@@ -0,0 +1,263 @@
+package plugins
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"bitbucket.org/psyche/types"
+	"bitbucket.org/psyche/utils"
+)
+
+type excludePlugin struct {
+	db      types.DBH
+	plugins Psyches
+}
+
+// Actions of exclusion rules
+const (
+	ExcludeAction = "exclude"
+	IncludeAction = "include"
+)
+
+// Bots and botler posting search results and relayed messages, indexing them would echo the index into itself
+var defaultExclusions = []string{
+	utils.BotPattern,
+	"557058:48faede9-ea1d-4bf0-8a33-07d02c1fe6c6",
+	"557058:58827303-cf25-4168-8846-6ae6080b1993",
+}
+
+// Reasons for skipping messages at indexer
+const (
+	SkipEmpty      = "empty"
+	SkipSender     = "sender_excluded"
+	SkipBot        = "sender_bot"
+	SkipUser       = "user_noindex"
+	SkipVocabulary = "vocabulary_optout"
+	SkipNoTags     = "no_tags"
+)
+
+// Number of messages skipped by the indexer per reason
+var skipCounters sync.Map
+
+func countSkip(reason string) {
+	val, _ := skipCounters.LoadOrStore(reason, new(int64))
+	atomic.AddInt64(val.(*int64), 1)
+}
+
+// SkipCounts returns the number of messages skipped by the indexer per reason since start
+func SkipCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	skipCounters.Range(func(k, v interface{}) bool {
+		counts[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+
+	return counts
+}
+
+// NewExcludePlugin creates an instance of exclude plugin implementing Psyche interface
+func NewExcludePlugin(db *sql.DB, p Psyches) Psyche {
+	r := &excludePlugin{types.DBH{db}, p}
+
+	if err := InitExclusions(db); err != nil {
+		return nil
+	}
+
+	return r
+}
+
+// InitExclusions creates the exclusions table with the default global exclusions.
+// Defaults are added along with the table only, so that defaults removed by an admin stay removed.
+func InitExclusions(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var created bool
+	if err = tx.QueryRow("SELECT to_regclass('exclusions') IS NULL").Scan(&created); err != nil {
+		return err
+	}
+
+	// Empty userbase_id applies to all userbases, empty room_id applies to all rooms in the userbase
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS exclusions (userbase_id text, room_id text, pattern text, action text, PRIMARY KEY (userbase_id, room_id, pattern))")
+	if err != nil {
+		return err
+	}
+
+	for _, id := range defaultExclusions {
+		if created {
+			_, err = tx.Exec("INSERT INTO exclusions VALUES('', '', $1, $2) ON CONFLICT DO NOTHING", id, ExcludeAction)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Handle manages sender exclusions of a room with the commands:
+//
+//	exclude <pattern> [...]    do not index messages from matching senders
+//	include <pattern> [...]    index messages from matching senders excluded at a broader scope
+//	remove <pattern> [...]     remove rules
+//	list                       list rules applying to the room
+//
+// Patterns are sender IDs, shell globs or "bot" for all senders flagged as bots.
+// Providing scope=userbase in the query URL applies the rules to all rooms in the userbase.
+func (p *excludePlugin) Handle(u *url.URL, rmsg *types.RecvMsg) (*types.SendMsg, error) {
+	// Context: userbaseID:chatroomID
+	scope := strings.SplitN(rmsg.Context, ":", 2)
+	if len(scope) != 2 {
+		return nil, types.ErrExclude{fmt.Errorf("missing userbase:chatroom for scope")}
+	}
+
+	val, ok := p.plugins["relay"]
+	if !ok {
+		return nil, types.ErrExclude{errors.New("failed to get relay plugin")}
+	}
+
+	relay, ok := val.(*relayPlugin)
+	if !ok {
+		return nil, types.ErrExclude{errors.New("failed to cast relay plugin interface")}
+	}
+
+	roomId := scope[1]
+	if u.Query().Get("scope") == "userbase" {
+		roomId = ""
+	}
+
+	fields := strings.Fields(rmsg.Message)
+	if len(fields) == 0 {
+		fields = []string{"list"}
+	}
+
+	var err error
+	var reply string
+	switch cmd := strings.ToLower(fields[0]); cmd {
+	case "list":
+		var buff bytes.Buffer
+		var rules []string
+		if rules, err = ListExclusions(p.db.DB, scope[0], scope[1]); err != nil {
+			return nil, err
+		}
+		for _, r := range rules {
+			buff.WriteString(r + "\n")
+		}
+		reply = fmt.Sprintf("%d exclusion rules:\n%s", len(rules), buff.String())
+	case ExcludeAction, IncludeAction:
+		for _, pattern := range fields[1:] {
+			if err = AddExclusion(p.db.DB, scope[0], roomId, pattern, cmd); err != nil {
+				return nil, err
+			}
+		}
+		reply = fmt.Sprintf("%s: %s", cmd, strings.Join(fields[1:], " "))
+	case "remove":
+		for _, pattern := range fields[1:] {
+			if err = RemoveExclusion(p.db.DB, scope[0], roomId, pattern); err != nil {
+				return nil, err
+			}
+		}
+		reply = fmt.Sprintf("removed: %s", strings.Join(fields[1:], " "))
+	default:
+		return nil, types.ErrExclude{fmt.Errorf("unknown command %s", rmsg.Message)}
+	}
+
+	return nil, relay.RelayMsg(rmsg, u.Query().Get("target"), types.NewSendMsg(reply))
+}
+
+func (p *excludePlugin) Refresh() error {
+	return nil
+}
+
+// AddExclusion adds or updates a rule, empty userbaseId and roomId widen the scope of the rule
+func AddExclusion(db *sql.DB, userbaseId, roomId, pattern, action string) error {
+	if action != ExcludeAction && action != IncludeAction {
+		return types.ErrExclude{fmt.Errorf("unknown action %s", action)}
+	}
+
+	_, err := db.Exec("INSERT INTO exclusions VALUES($1, $2, $3, $4) ON CONFLICT (userbase_id, room_id, pattern) DO UPDATE SET action=$4",
+		userbaseId, roomId, pattern, action)
+
+	return err
+}
+
+// RemoveExclusion removes a rule
+func RemoveExclusion(db *sql.DB, userbaseId, roomId, pattern string) error {
+	_, err := db.Exec("DELETE FROM exclusions WHERE userbase_id=$1 AND room_id=$2 AND pattern=$3", userbaseId, roomId, pattern)
+	return err
+}
+
+// ListExclusions describes the rules applying to a room, all rules if userbaseId is empty
+func ListExclusions(db *sql.DB, userbaseId, roomId string) ([]string, error) {
+	var err error
+	var rows *sql.Rows
+	if len(userbaseId) == 0 {
+		rows, err = db.Query("SELECT userbase_id, room_id, pattern, action FROM exclusions ORDER BY userbase_id, room_id, pattern")
+	} else {
+		rows, err = db.Query("SELECT userbase_id, room_id, pattern, action FROM exclusions WHERE userbase_id='' OR (userbase_id=$1 AND (room_id='' OR room_id=$2)) ORDER BY userbase_id, room_id, pattern",
+			userbaseId, roomId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []string
+	var ub, room, pattern, action string
+	for rows.Next() {
+		if err = rows.Scan(&ub, &room, &pattern, &action); err != nil {
+			return nil, err
+		}
+
+		scope := "global"
+		if len(room) > 0 {
+			scope = ub + ":" + room
+		} else if len(ub) > 0 {
+			scope = ub
+		}
+		rules = append(rules, fmt.Sprintf("%s %s (%s)", action, pattern, scope))
+	}
+
+	return rules, rows.Err()
+}
+
+// excludedSender returns the rule excluding the sender of the message in the room, nil if not excluded
+func excludedSender(db types.DBH, userbaseId, roomId string, rmsg *types.RecvMsg) (*utils.ExclusionRule, error) {
+	rows, err := db.Query("SELECT userbase_id, room_id, pattern, action FROM exclusions WHERE userbase_id='' OR (userbase_id=$1 AND (room_id='' OR room_id=$2))",
+		userbaseId, roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []utils.ExclusionRule
+	var ub, room, pattern, action string
+	for rows.Next() {
+		if err = rows.Scan(&ub, &room, &pattern, &action); err != nil {
+			return nil, err
+		}
+
+		r := utils.ExclusionRule{Pattern: pattern, Include: action == IncludeAction, Scope: utils.ScopeGlobal}
+		if len(room) > 0 {
+			r.Scope = utils.ScopeRoom
+		} else if len(ub) > 0 {
+			r.Scope = utils.ScopeUserbase
+		}
+		rules = append(rules, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return utils.ExcludeSender(rules, rmsg.Sender.ID, rmsg.Sender.Bot), nil
+}
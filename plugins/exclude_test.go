@@ -0,0 +1,30 @@
+package plugins
+
+import (
+	"fmt"
+	"testing"
+
+	"bitbucket.org/psyche/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemovedDefaultExclusionsStayRemoved(t *testing.T) {
+	db := testDB(t)
+
+	require.NoError(t, InitExclusions(db))
+	rules, err := ListExclusions(db, "", "")
+	require.NoError(t, err)
+	require.Len(t, rules, len(defaultExclusions))
+
+	bot := fmt.Sprintf("%s %s (global)", ExcludeAction, utils.BotPattern)
+	require.Contains(t, rules, bot)
+
+	// Restarting does not add the default back
+	require.NoError(t, RemoveExclusion(db, "", "", utils.BotPattern))
+	require.NoError(t, InitExclusions(db))
+
+	rules, err = ListExclusions(db, "", "")
+	require.NoError(t, err)
+	require.Len(t, rules, len(defaultExclusions)-1)
+	require.NotContains(t, rules, bot)
+}
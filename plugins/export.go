@@ -0,0 +1,231 @@
+package plugins
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/psyche/types"
+)
+
+// Formats of search exports
+const (
+	ExportCSV      = "csv"
+	ExportNDJSON   = "ndjson"
+	ExportMarkdown = "markdown"
+)
+
+var exportTypes = map[string]struct{ ext, contentType string }{
+	ExportCSV:      {"csv", "text/csv; charset=utf-8"},
+	ExportNDJSON:   {"ndjson", "application/x-ndjson"},
+	ExportMarkdown: {"md", "text/markdown; charset=utf-8"},
+}
+
+// Exports are stored in ExportDir and linked under ExportURL, they are posted as messages without a file store.
+// ExportMaxSize bounds the size of an export in bytes, ExportMessageMaxSize the size of one posted as a message. They are set at startup.
+var (
+	ExportDir            string
+	ExportURL            string
+	ExportMaxSize        = 1 << 20
+	ExportMessageMaxSize = 3500
+)
+
+// Stored exports are removed by the janitor after a day
+const exportRetention = 24 * time.Hour
+
+// Names of stored exports, random so that links cannot be guessed
+var exportNameRx = regexp.MustCompile(`^[0-9a-f]{32}\.(csv|ndjson|md)$`)
+
+// IsExportFormat reports if format is a supported export format
+func IsExportFormat(format string) bool {
+	_, ok := exportTypes[format]
+	return ok
+}
+
+// ExportContentType is the content type of an export, with the file extension
+func ExportContentType(format string) (string, string) {
+	t := exportTypes[format]
+	return t.contentType, t.ext
+}
+
+// csvCell escapes text spreadsheets would evaluate as a formula
+func csvCell(text string) string {
+	if len(text) > 0 && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+
+	return text
+}
+
+// WriteExport renders the hits in the order they were sent until maxSize bytes, returning the number of hits exported
+func WriteExport(buff *bytes.Buffer, format, title string, hits []SearchHit, maxSize int) (int, error) {
+	hits = append([]SearchHit{}, hits...)
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Time.Before(hits[j].Time)
+	})
+
+	var record bytes.Buffer
+	switch format {
+	case ExportCSV:
+		w := csv.NewWriter(&record)
+		w.Write([]string{"id", "room", "thread_id", "sender", "sender_name", "time", "tags", "keywords", "message", "permalink", "score"})
+		w.Flush()
+	case ExportMarkdown:
+		record.WriteString("# " + title + "\n")
+	case ExportNDJSON:
+	default:
+		return 0, types.ErrSearch{fmt.Errorf("unknown export format %s", format)}
+	}
+	if record.Len() > maxSize {
+		return 0, nil
+	}
+	buff.Write(record.Bytes())
+
+	for i, h := range hits {
+		record.Reset()
+		switch format {
+		case ExportCSV:
+			w := csv.NewWriter(&record)
+			w.Write([]string{csvCell(h.ID), csvCell(h.Room), csvCell(h.ThreadID), csvCell(h.Sender), csvCell(h.SenderName), h.Time.UTC().Format(time.RFC3339),
+				csvCell(strings.Join(h.Tags, " ")), csvCell(strings.Join(h.Keywords, " ")), csvCell(h.Message), csvCell(h.Permalink), strconv.FormatFloat(h.Score, 'f', 2, 64)})
+			w.Flush()
+		case ExportNDJSON:
+			b, err := json.Marshal(h)
+			if err != nil {
+				return i, types.ErrSearch{err}
+			}
+			record.Write(append(b, '\n'))
+		case ExportMarkdown:
+			sender := h.SenderName
+			if len(sender) == 0 {
+				sender = h.Sender
+			}
+			record.WriteString(fmt.Sprintf("\n## %s %s\n\n", h.Time.UTC().Format("2006-01-02 15:04"), sender))
+			for _, line := range strings.Split(strings.TrimSpace(h.Message), "\n") {
+				record.WriteString("> " + line + "\n")
+			}
+			if len(h.Tags) > 0 {
+				record.WriteString("\n#" + strings.Join(h.Tags, " #") + "\n")
+			}
+			if len(h.Permalink) > 0 {
+				record.WriteString("\n" + h.Permalink + "\n")
+			}
+		}
+
+		if buff.Len()+record.Len() > maxSize {
+			return i, nil
+		}
+		buff.Write(record.Bytes())
+	}
+
+	return len(hits), nil
+}
+
+// storeExport saves an export to the file store and returns its link
+func storeExport(format string, data []byte) (string, error) {
+	_, ext := ExportContentType(format)
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(b) + "." + ext
+
+	if err := ioutil.WriteFile(filepath.Join(ExportDir, name), data, 0600); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(ExportURL, "/") + "/" + name, nil
+}
+
+// ExportPath is the path of a stored export, false for names that cannot be exports
+func ExportPath(name string) (string, bool) {
+	if len(ExportDir) == 0 || !exportNameRx.MatchString(name) {
+		return "", false
+	}
+
+	return filepath.Join(ExportDir, name), true
+}
+
+// ExpireExports removes the stored exports older than a day, returning the number of exports removed
+func ExpireExports() (int, error) {
+	if len(ExportDir) == 0 {
+		return 0, nil
+	}
+
+	files, err := ioutil.ReadDir(ExportDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, f := range files {
+		if !exportNameRx.MatchString(f.Name()) || time.Since(f.ModTime()) < exportRetention {
+			continue
+		}
+		if err = os.Remove(filepath.Join(ExportDir, f.Name())); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// export runs the search of the request and delivers the matches as a link to the stored export, or as the reply
+func (p *searchPlugin) export(r SearchRequest, format string) (*types.SendMsg, error) {
+	results, err := Search(p, r)
+	if err != nil || len(results.Hits) == 0 {
+		return nil, err
+	}
+
+	// Exports posted as messages must fit in a chat message
+	stored := len(ExportDir) > 0 && len(ExportURL) > 0
+	maxSize := ExportMaxSize
+	if !stored && ExportMessageMaxSize < maxSize {
+		maxSize = ExportMessageMaxSize
+	}
+
+	var buff bytes.Buffer
+	count, err := WriteExport(&buff, format, "Search: "+strings.TrimSpace(r.Text), results.Hits, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var note string
+	if count < len(results.Hits) || results.Truncated {
+		note = fmt.Sprintf("exported %d of the matching messages, exports are limited to %d messages and %d bytes", count, maxSearchLimit, maxSize)
+	}
+
+	if !stored {
+		smsg := types.NewSendMsg(buff.String())
+		if format == ExportMarkdown {
+			smsg.Format = formatMarkdown
+		}
+		if len(note) > 0 {
+			smsg.Text += "\n" + note + "\n"
+		}
+		return smsg, nil
+	}
+
+	link, err := storeExport(format, buff.Bytes())
+	if err != nil {
+		return nil, types.ErrSearch{fmt.Errorf("failed to store export with error %s", err)}
+	}
+
+	if len(note) == 0 {
+		note = fmt.Sprintf("exported %d messages", count)
+	}
+	return types.NewSendMsg(fmt.Sprintf("%s, the link expires in a day:\n%s\n", note, link)), nil
+}
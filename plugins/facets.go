@@ -0,0 +1,126 @@
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Entries shown for each facet
+const facetLimit = 10
+
+// Facets of the messages matching a query, in the order shown
+const (
+	FacetSender = "sender"
+	FacetDay    = "day"
+	FacetWeek   = "week"
+	FacetTag    = "tag"
+	FacetRoom   = "room"
+)
+
+var facetTitles = map[string]string{
+	FacetSender: "Senders",
+	FacetDay:    "Days",
+	FacetWeek:   "Weeks",
+	FacetTag:    "Related tags",
+	FacetRoom:   "Rooms",
+}
+
+// facetQuery counts the matching messages by each facet, days and weeks most recent first, tags other than the query terms.
+// The total count comes first with an empty facet. Without a room, the rooms are those the requester in $8 sent messages to.
+const facetQuery = `WITH matched AS (SELECT user_id, sender_name, room_id, ctime, tags FROM indexer WHERE userbase_id=$1
+		AND (room_id=$2 OR ($2='' AND room_id IN (SELECT DISTINCT room_id FROM indexer WHERE userbase_id=$1 AND user_id=$8))) AND %s)
+	(SELECT '' AS facet, '' AS value, count(*) AS n FROM matched)
+	UNION ALL (SELECT '` + FacetSender + `', COALESCE(NULLIF(max(sender_name), ''), user_id), count(*) FROM matched GROUP BY user_id ORDER BY 3 DESC, 2 LIMIT $4)
+	UNION ALL (SELECT '` + FacetDay + `', to_char(date_trunc('day', ctime), 'YYYY-MM-DD'), count(*) FROM matched GROUP BY 2 ORDER BY 2 DESC LIMIT $4)
+	UNION ALL (SELECT '` + FacetWeek + `', to_char(date_trunc('week', ctime), 'IYYY-"W"IW'), count(*) FROM matched GROUP BY 2 ORDER BY 2 DESC LIMIT $4)
+	UNION ALL (SELECT '` + FacetTag + `', tag, count(*) FROM matched, unnest(tags) AS tag WHERE NOT tag = ANY($3) GROUP BY tag ORDER BY 3 DESC, 2 LIMIT $4)
+	UNION ALL (SELECT '` + FacetRoom + `', room_id, count(*) FROM matched GROUP BY room_id ORDER BY 3 DESC, 2 LIMIT $4)`
+
+type facetCount struct {
+	value string
+	count int
+}
+
+// facets summarizes the messages matching the query in the room, or in the rooms of the userbase the requester sent messages to.
+// The reply is empty without matches.
+func (p *searchPlugin) facets(userbaseId, roomId, requesterId, userId, text string, allRooms bool, f *resultFormat) (string, error) {
+	// Vocabulary and aliases of the room searched from
+	q, err := loadQuery(p.db, userbaseId, roomId, text)
+	if err != nil || q.Empty() {
+		return "", err
+	}
+
+	matchRoom := roomId
+	if allRooms {
+		matchRoom = ""
+	}
+
+	rows, err := p.db.Query(fmt.Sprintf(facetQuery, matchCondition(q)), userbaseId, matchRoom, pq.Array(append([]string{}, q.Tags...)),
+		facetLimit, userId, pq.Array(append([]string{}, q.Has...)), pq.Array(append([]string{}, q.Tickets...)), requesterId)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var total int
+	var counts = make(map[string][]facetCount)
+	for rows.Next() {
+		var facet string
+		var c facetCount
+		if err = rows.Scan(&facet, &c.value, &c.count); err != nil {
+			return "", err
+		}
+
+		if len(facet) == 0 {
+			total = c.count
+		} else {
+			counts[facet] = append(counts[facet], c)
+		}
+	}
+	if err = rows.Err(); err != nil || total == 0 {
+		return "", err
+	}
+
+	relay, _ := p.plugins["relay"].(*relayPlugin)
+	roomName := func(id string) string {
+		if relay != nil {
+			if name := relay.RoomName(userbaseId + ":" + id); len(name) > 0 {
+				return name
+			}
+		}
+		return id
+	}
+
+	var buff bytes.Buffer
+	if allRooms {
+		buff.WriteString(fmt.Sprintf("%d messages in your rooms:\n", total))
+	} else {
+		buff.WriteString(fmt.Sprintf("%d messages in %s:\n", total, roomName(roomId)))
+	}
+
+	for _, facet := range []string{FacetSender, FacetDay, FacetWeek, FacetTag, FacetRoom} {
+		// All the matches are in the room searched
+		if len(counts[facet]) == 0 || (facet == FacetRoom && !allRooms) {
+			continue
+		}
+
+		var entries []string
+		for _, c := range counts[facet] {
+			if facet == FacetRoom {
+				c.value = roomName(c.value)
+			}
+			entries = append(entries, fmt.Sprintf("%s %d", c.value, c.count))
+		}
+
+		title := facetTitles[facet]
+		if f.format == formatMarkdown {
+			title = "**" + title + "**"
+		}
+		buff.WriteString(fmt.Sprintf("\n%s: %s\n", title, strings.Join(entries, ", ")))
+	}
+
+	return buff.String(), nil
+}
@@ -0,0 +1,67 @@
+package plugins
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"bitbucket.org/psyche/types"
+)
+
+type forgetPlugin struct {
+	db      types.DBH
+	plugins Psyches
+}
+
+// NewForgetPlugin creates an instance of forget plugin implementing Psyche interface
+func NewForgetPlugin(db *sql.DB, p Psyches) Psyche {
+	return &forgetPlugin{types.DBH{db}, p}
+}
+
+// Handle removes messages of the sender from the index of the room.
+// The message lists message IDs or permalinks, "last" removes the most recently indexed message
+// and "everything" removes all messages and preferences of the sender in the userbase.
+func (p *forgetPlugin) Handle(u *url.URL, rmsg *types.RecvMsg) (*types.SendMsg, error) {
+	// Context: userbaseID:chatroomID
+	scope := strings.SplitN(rmsg.Context, ":", 2)
+	if len(scope) != 2 {
+		return nil, types.ErrForget{fmt.Errorf("missing userbase:chatroom for scope")}
+	}
+
+	val, ok := p.plugins["relay"]
+	if !ok {
+		return nil, types.ErrForget{errors.New("failed to get relay plugin")}
+	}
+
+	relay, ok := val.(*relayPlugin)
+	if !ok {
+		return nil, types.ErrForget{errors.New("failed to cast relay plugin interface")}
+	}
+
+	ids := strings.Fields(rmsg.Message)
+	if len(ids) == 0 {
+		return nil, types.ErrForget{errors.New("missing message IDs to forget")}
+	}
+
+	// Users can only remove their own messages
+	var count int64
+	var err error
+	if len(ids) == 1 && strings.ToLower(ids[0]) == "last" {
+		count, err = tombstoneLast(p.db, scope[0], scope[1], rmsg.Sender.ID)
+	} else if len(ids) == 1 && strings.ToLower(ids[0]) == "everything" {
+		count, err = ForgetUser(p.db.DB, scope[0], rmsg.Sender.ID)
+	} else {
+		count, err = tombstoneMessages(p.db, scope[0], scope[1], rmsg.Sender.ID, ids)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, relay.RelayMsg(rmsg, u.Query().Get("target"), types.NewSendMsg(fmt.Sprintf("removed %d of your messages from the index", count)))
+}
+
+func (p *forgetPlugin) Refresh() error {
+	return nil
+}
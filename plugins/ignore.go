@@ -0,0 +1,204 @@
+package plugins
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"bitbucket.org/psyche/types"
+	"bitbucket.org/psyche/utils"
+	"github.com/lib/pq"
+)
+
+type ignorePlugin struct {
+	db      types.DBH
+	plugins Psyches
+}
+
+// Kinds of vocabulary entries
+const (
+	vocabularyIgnore = "ignore"
+	vocabularyOptOut = "optout"
+	vocabularyAllow  = "allow"
+)
+
+// NewIgnorePlugin creates an instance of ignore plugin implementing Psyche interface
+func NewIgnorePlugin(db *sql.DB, p Psyches) Psyche {
+	r := &ignorePlugin{types.DBH{db}, p}
+
+	// Entries with empty room_id apply to all rooms in the userbase
+	_, err := r.db.Exec("CREATE TABLE IF NOT EXISTS vocabulary (userbase_id text, room_id text, word text, kind text, PRIMARY KEY (userbase_id, room_id, word))")
+	if err != nil {
+		return nil
+	}
+
+	_, err = r.db.Exec("CREATE TABLE IF NOT EXISTS user_prefs (userbase_id text, user_id text, noindex boolean, PRIMARY KEY (userbase_id, user_id))")
+	if err != nil {
+		return nil
+	}
+
+	return r
+}
+
+// Handle manages the vocabulary of a room and indexing preference of the sender with the commands:
+//
+//	ignore @standup [...]    strip words from messages and queries
+//	optout @private [...]    do not index messages with the words
+//	allow @here [...]        index messages with words ignored by default
+//	remove @standup [...]    remove words from the room vocabulary
+//	noindex on|off           never index messages from the sender
+//	list                     list the room vocabulary
+//
+// Providing scope=userbase in the query URL applies the words to all rooms in the userbase.
+func (p *ignorePlugin) Handle(u *url.URL, rmsg *types.RecvMsg) (*types.SendMsg, error) {
+	// Context: userbaseID:chatroomID
+	scope := strings.SplitN(rmsg.Context, ":", 2)
+	if len(scope) != 2 {
+		return nil, types.ErrIgnore{fmt.Errorf("missing userbase:chatroom for scope")}
+	}
+
+	val, ok := p.plugins["relay"]
+	if !ok {
+		return nil, types.ErrIgnore{errors.New("failed to get relay plugin")}
+	}
+
+	relay, ok := val.(*relayPlugin)
+	if !ok {
+		return nil, types.ErrIgnore{errors.New("failed to cast relay plugin interface")}
+	}
+
+	roomId := scope[1]
+	if u.Query().Get("scope") == "userbase" {
+		roomId = ""
+	}
+
+	fields := strings.Fields(strings.ToLower(rmsg.Message))
+
+	var reply string
+	var err error
+	switch {
+	case len(fields) == 0 || fields[0] == "list":
+		reply, err = p.list(scope[0], scope[1])
+	case fields[0] == "noindex" && len(fields) > 1:
+		reply, err = p.noindex(scope[0], rmsg.Sender.ID, fields[1] == "on" || fields[1] == "true")
+	case fields[0] == "remove":
+		reply, err = p.remove(scope[0], roomId, fields[1:])
+	case fields[0] == vocabularyIgnore || fields[0] == vocabularyOptOut || fields[0] == vocabularyAllow:
+		reply, err = p.add(scope[0], roomId, fields[0], fields[1:])
+	default:
+		return nil, types.ErrIgnore{fmt.Errorf("unknown command %s", rmsg.Message)}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, relay.RelayMsg(rmsg, u.Query().Get("target"), types.NewSendMsg(reply))
+}
+
+func (p *ignorePlugin) add(userbaseId, roomId, kind string, words []string) (string, error) {
+	if len(words) == 0 {
+		return "", types.ErrIgnore{fmt.Errorf("missing words to %s", kind)}
+	}
+
+	for _, w := range words {
+		_, err := p.db.Exec("INSERT INTO vocabulary VALUES($1, $2, $3, $4) ON CONFLICT (userbase_id, room_id, word) DO UPDATE SET kind=$4",
+			userbaseId, roomId, w, kind)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%s: %s", kind, strings.Join(words, " ")), nil
+}
+
+func (p *ignorePlugin) remove(userbaseId, roomId string, words []string) (string, error) {
+	_, err := p.db.Exec("DELETE FROM vocabulary WHERE userbase_id=$1 AND room_id=$2 AND word = ANY($3)",
+		userbaseId, roomId, pq.Array(words))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("removed: %s", strings.Join(words, " ")), nil
+}
+
+func (p *ignorePlugin) noindex(userbaseId, userId string, on bool) (string, error) {
+	_, err := p.db.Exec("INSERT INTO user_prefs VALUES($1, $2, $3) ON CONFLICT (userbase_id, user_id) DO UPDATE SET noindex=$3",
+		userbaseId, userId, on)
+	if err != nil {
+		return "", err
+	}
+
+	if on {
+		return "your messages will not be indexed", nil
+	}
+
+	return "your messages will be indexed", nil
+}
+
+func (p *ignorePlugin) list(userbaseId, roomId string) (string, error) {
+	v, err := loadVocabulary(p.db, userbaseId, roomId)
+	if err != nil {
+		return "", err
+	}
+
+	var buff bytes.Buffer
+	buff.WriteString("ignore:")
+	for w := range v.Ignore {
+		buff.WriteString(" " + w)
+	}
+	buff.WriteString("\noptout:")
+	for w := range v.OptOut {
+		buff.WriteString(" " + w)
+	}
+
+	return buff.String(), nil
+}
+
+func (p *ignorePlugin) Refresh() error {
+	return nil
+}
+
+// loadVocabulary returns the default vocabulary amended by the userbase and then the room entries
+func loadVocabulary(db types.DBH, userbaseId, roomId string) (*utils.Vocabulary, error) {
+	rows, err := db.Query("SELECT word, kind FROM vocabulary WHERE userbase_id=$1 AND (room_id='' OR room_id=$2) ORDER BY room_id",
+		userbaseId, roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	v := utils.DefaultVocabulary()
+
+	var word, kind string
+	for rows.Next() {
+		if err = rows.Scan(&word, &kind); err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case vocabularyIgnore:
+			v.AddIgnore(word)
+		case vocabularyOptOut:
+			v.AddOptOut(word)
+		case vocabularyAllow:
+			v.Allow(word)
+		}
+	}
+
+	return v, rows.Err()
+}
+
+// userOptedOut reports if the user asked to never index their messages
+func userOptedOut(db types.DBH, userbaseId, userId string) (bool, error) {
+	var noindex bool
+	err := db.QueryRow("SELECT noindex FROM user_prefs WHERE userbase_id=$1 AND user_id=$2", userbaseId, userId).Scan(&noindex)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return noindex, err
+}
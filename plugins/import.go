@@ -0,0 +1,189 @@
+package plugins
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bitbucket.org/psyche/types"
+)
+
+// Concurrent workers of an import by default and at most
+const (
+	importWorkers    = 4
+	maxImportWorkers = 16
+)
+
+// Lines between two progress reports
+const importProgressLines = 1000
+
+// Longest line accepted in an export
+const maxImportLine = 1024 * 1024
+
+// ImportRecord is a message of an NDJSON export, one per line
+type ImportRecord struct {
+	ID string `json:"id"`
+
+	// userbaseID:chatroomID, ImportOptions.Context if empty
+	Room       string    `json:"room"`
+	Sender     string    `json:"sender"`
+	SenderName string    `json:"sender_name"`
+	Message    string    `json:"message"`
+	Timestamp  time.Time `json:"timestamp"`
+	ThreadID   string    `json:"thread_id"`
+	Permalink  string    `json:"permalink"`
+}
+
+// ImportOptions controls a bulk import
+type ImportOptions struct {
+	// Default userbaseID:chatroomID of records without a room
+	Context string
+
+	// Number of messages indexed concurrently
+	Workers int
+
+	// Index messages without hash tags
+	DisableHashCheck bool
+}
+
+// ImportStats is the progress of a bulk import
+type ImportStats struct {
+	Lines      int64 `json:"lines"`
+	Indexed    int64 `json:"indexed"`
+	Duplicates int64 `json:"duplicates"`
+	Skipped    int64 `json:"skipped"`
+	Failed     int64 `json:"failed"`
+}
+
+func (s *ImportStats) snapshot() ImportStats {
+	return ImportStats{
+		Lines:      atomic.LoadInt64(&s.Lines),
+		Indexed:    atomic.LoadInt64(&s.Indexed),
+		Duplicates: atomic.LoadInt64(&s.Duplicates),
+		Skipped:    atomic.LoadInt64(&s.Skipped),
+		Failed:     atomic.LoadInt64(&s.Failed),
+	}
+}
+
+type importLine struct {
+	num  int64
+	data []byte
+}
+
+// Import indexes the NDJSON export read from r with the indexer plugin.
+// Messages already indexed are counted as duplicates, progress is called every importProgressLines lines.
+func Import(indexer Psyche, r io.Reader, opts ImportOptions, progress func(ImportStats)) (ImportStats, error) {
+	p, ok := indexer.(*indexerPlugin)
+	if !ok {
+		return ImportStats{}, types.ErrImport{fmt.Errorf("import requires the indexer plugin")}
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = importWorkers
+	}
+	if workers > maxImportWorkers {
+		workers = maxImportWorkers
+	}
+
+	var stats ImportStats
+	report := func() {
+		if progress != nil {
+			progress(stats.snapshot())
+		}
+	}
+
+	lines := make(chan importLine, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range lines {
+				outcome, err := p.importLine(l.data, opts)
+				switch {
+				case err != nil:
+					atomic.AddInt64(&stats.Failed, 1)
+					log.Printf("import failed at line %d with error %s", l.num, err)
+				case outcome == outcomeIndexed:
+					atomic.AddInt64(&stats.Indexed, 1)
+				case outcome == outcomeDuplicate:
+					atomic.AddInt64(&stats.Duplicates, 1)
+				default:
+					atomic.AddInt64(&stats.Skipped, 1)
+				}
+			}
+		}()
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+
+	var num int64
+	for scanner.Scan() {
+		num++
+		data := scanner.Bytes()
+		if len(strings.TrimSpace(string(data))) == 0 {
+			continue
+		}
+
+		// The scanner reuses its buffer
+		lines <- importLine{num, append([]byte(nil), data...)}
+
+		if atomic.AddInt64(&stats.Lines, 1)%importProgressLines == 0 {
+			report()
+		}
+	}
+	close(lines)
+	wg.Wait()
+
+	report()
+
+	if err := scanner.Err(); err != nil {
+		return stats.snapshot(), types.ErrImport{fmt.Errorf("failed to read line %d with error %s", num+1, err)}
+	}
+
+	return stats.snapshot(), nil
+}
+
+// importLine decodes a record and indexes it like a message received at the indexer
+func (p *indexerPlugin) importLine(data []byte, opts ImportOptions) (string, error) {
+	var rec ImportRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return "", types.ErrImport{fmt.Errorf("invalid record with error %s", err)}
+	}
+
+	room := rec.Room
+	if len(room) == 0 {
+		room = opts.Context
+	}
+
+	// Context: userbaseID:chatroomID
+	scope := strings.SplitN(room, ":", 2)
+	if len(scope) != 2 {
+		return "", types.ErrImport{fmt.Errorf("missing userbase:chatroom for record")}
+	}
+	if len(rec.Sender) == 0 || rec.Timestamp.IsZero() {
+		return "", types.ErrImport{fmt.Errorf("missing sender or timestamp for record")}
+	}
+
+	rmsg := &types.RecvMsg{
+		ID:        rec.ID,
+		Message:   rec.Message,
+		Context:   room,
+		Timestamp: rec.Timestamp,
+		ThreadID:  rec.ThreadID,
+		Permalink: rec.Permalink,
+	}
+	rmsg.Sender.ID = rec.Sender
+	rmsg.Sender.Name = rec.SenderName
+
+	outcome, _, err := p.index(scope[0], scope[1], rmsg, opts.DisableHashCheck)
+	return outcome, err
+}
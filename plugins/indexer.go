@@ -4,8 +4,11 @@ import (
 	"database/sql"
 	"fmt"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"bitbucket.org/psyche/types"
 	"bitbucket.org/psyche/utils"
@@ -23,6 +26,35 @@ const tagsPerMessage = 0.1
 // Minimum number of words in a message without tags
 const minWordsPerMessage = 5
 
+// Copies of a message without ID nor time arriving this soon after are deliveries of the same message
+const redeliveryWindow = time.Minute
+
+// Notifications of indexed messages run on a few workers, a full queue holds up indexing rather than the DB pool
+const (
+	notifyWorkers   = 4
+	notifyQueueSize = 256
+)
+
+var (
+	notifyQueue = make(chan func(), notifyQueueSize)
+	notifyStart sync.Once
+)
+
+// notifyLater queues a notification sent after the message is acknowledged, waiting while the queue is full
+func notifyLater(f func()) {
+	notifyStart.Do(func() {
+		for i := 0; i < notifyWorkers; i++ {
+			go func() {
+				for f := range notifyQueue {
+					f()
+				}
+			}()
+		}
+	})
+
+	notifyQueue <- f
+}
+
 // NewIndexerPlugin creates an instance of indexer plugin implementing Psyche interface
 func NewIndexerPlugin(db *sql.DB, p Psyches) Psyche {
 	r := &indexerPlugin{types.DBH{db}, p}
@@ -35,38 +67,620 @@ func NewIndexerPlugin(db *sql.DB, p Psyches) Psyche {
 		return nil
 	}
 
+	// Original message identity and metadata to link back to the chat
+	_, err = r.db.Exec("ALTER TABLE indexer ADD COLUMN IF NOT EXISTS message_id text, ADD COLUMN IF NOT EXISTS thread_id text, ADD COLUMN IF NOT EXISTS sender_name text, ADD COLUMN IF NOT EXISTS mentions text[], ADD COLUMN IF NOT EXISTS attachments text[], ADD COLUMN IF NOT EXISTS permalink text")
+	if err != nil {
+		return nil
+	}
+
+	// Noun phrases and named entities searchable as quoted phrases
+	_, err = r.db.Exec("ALTER TABLE indexer ADD COLUMN IF NOT EXISTS entities text[]")
+	if err != nil {
+		return nil
+	}
+
+	// Edited and deleted messages, deleted messages are kept as tombstones without content
+	_, err = r.db.Exec("ALTER TABLE indexer ADD COLUMN IF NOT EXISTS edited_at timestamp, ADD COLUMN IF NOT EXISTS deleted_at timestamp")
+	if err != nil {
+		return nil
+	}
+
+	// Links, ticket keys and kinds of artifacts like code and stack traces
+	_, err = r.db.Exec("ALTER TABLE indexer ADD COLUMN IF NOT EXISTS links text[], ADD COLUMN IF NOT EXISTS tickets text[], ADD COLUMN IF NOT EXISTS has text[]")
+	if err != nil {
+		return nil
+	}
+
+	// Detected language of the message
+	_, err = r.db.Exec("ALTER TABLE indexer ADD COLUMN IF NOT EXISTS lang text")
+	if err != nil {
+		return nil
+	}
+
+	// Hash tags of all messages of the thread, for messages found by the tags of their thread
+	_, err = r.db.Exec("ALTER TABLE indexer ADD COLUMN IF NOT EXISTS thread_tags text[]")
+	if err != nil {
+		return nil
+	}
+
+	// Untagged messages kept for their thread only, expired unless the thread gets tagged
+	_, err = r.db.Exec("ALTER TABLE indexer ADD COLUMN IF NOT EXISTS context boolean DEFAULT false")
+	if err != nil {
+		return nil
+	}
+
+	_, err = r.db.Exec("CREATE INDEX IF NOT EXISTS indexer_thread ON indexer (userbase_id, room_id, thread_id)")
+	if err != nil {
+		return nil
+	}
+
+	_, err = r.db.Exec("CREATE INDEX IF NOT EXISTS indexer_message ON indexer (userbase_id, room_id, message_id)")
+	if err != nil {
+		return nil
+	}
+
+	// Concurrent deliveries of a message are indexed once, copies indexed before are dropped for the unique index to build
+	_, err = r.db.Exec("DELETE FROM indexer a USING indexer b WHERE a.userbase_id=b.userbase_id AND a.room_id=b.room_id AND a.message_id=b.message_id AND a.message_id <> '' AND a.ctid > b.ctid AND to_regclass('indexer_message_id') IS NULL")
+	if err != nil {
+		return nil
+	}
+
+	_, err = r.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS indexer_message_id ON indexer (userbase_id, room_id, message_id) WHERE message_id <> ''")
+	if err != nil {
+		return nil
+	}
+
+	// Messages without ID are recognized by sender and a hash of the content, cleared with the content of deleted messages
+	_, err = r.db.Exec("ALTER TABLE indexer ADD COLUMN IF NOT EXISTS message_hash text")
+	if err != nil {
+		return nil
+	}
+
+	_, err = r.db.Exec("UPDATE indexer SET message_hash=md5(message) WHERE message_hash IS NULL AND deleted_at IS NULL")
+	if err != nil {
+		return nil
+	}
+
+	_, err = r.db.Exec("CREATE INDEX IF NOT EXISTS indexer_message_hash ON indexer (userbase_id, room_id, user_id, message_hash)")
+	if err != nil {
+		return nil
+	}
+
+	// Stable row order for batch jobs walking the table
+	_, err = r.db.Exec("ALTER TABLE indexer ADD COLUMN IF NOT EXISTS id bigserial")
+	if err != nil {
+		return nil
+	}
+
+	_, err = r.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS indexer_id ON indexer (id)")
+	if err != nil {
+		return nil
+	}
+
+	// Reactions notified by the chat platform count towards the search score
+	_, err = r.db.Exec("ALTER TABLE indexer ADD COLUMN IF NOT EXISTS reactions int DEFAULT 0")
+	if err != nil {
+		return nil
+	}
+
+	// Terms of the message counted in the room stats, withdrawn when the message is removed or indexed again.
+	// Messages indexed before terms were stored count their tags and keywords instead.
+	_, err = r.db.Exec("ALTER TABLE indexer ADD COLUMN IF NOT EXISTS terms text[]")
+	if err != nil {
+		return nil
+	}
+
+	_, err = r.db.Exec("UPDATE indexer SET terms = ARRAY(SELECT DISTINCT unnest(COALESCE(tags, '{}') || COALESCE(keywords, '{}'))) WHERE terms IS NULL AND deleted_at IS NULL")
+	if err != nil {
+		return nil
+	}
+
+	if err = initRoomStats(db); err != nil {
+		return nil
+	}
+
+	if err = InitReindex(db); err != nil {
+		return nil
+	}
+
 	return r
 }
 
-func (p *indexerPlugin) Handle(u *url.URL, rmsg *types.RecvMsg) (*types.SendMsg, error) {
-	if len(rmsg.Message) == 0 ||
-		// Explicitly ignore messages from botler
-		rmsg.Sender.ID == "557058:48faede9-ea1d-4bf0-8a33-07d02c1fe6c6" ||
-		rmsg.Sender.ID == "557058:58827303-cf25-4168-8846-6ae6080b1993" {
-		return nil, nil
+// initRoomStats creates the per room document frequencies for ranking enrichment keywords.
+// New tables are filled from the messages indexed so far, so that removing them withdraws terms which were counted.
+func initRoomStats(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	disableHashCheck, _ := strconv.ParseBool(u.Query().Get("disableHashCheck"))
+	var created bool
+	if err = tx.QueryRow("SELECT to_regclass('room_docs') IS NULL").Scan(&created); err != nil {
+		return err
+	}
 
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS room_docs (userbase_id text, room_id text, docs int, PRIMARY KEY (userbase_id, room_id))")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS room_terms (userbase_id text, room_id text, term text, df int, PRIMARY KEY (userbase_id, room_id, term))")
+	if err != nil {
+		return err
+	}
+
+	if created {
+		_, err = tx.Exec("INSERT INTO room_docs SELECT userbase_id, room_id, count(*) FROM indexer WHERE " + countedMessages + " GROUP BY userbase_id, room_id ON CONFLICT DO NOTHING")
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO room_terms SELECT userbase_id, room_id, term, count(*) FROM indexer, unnest(COALESCE(terms, '{}')) AS term WHERE " + countedMessages + " GROUP BY userbase_id, room_id, term ON CONFLICT DO NOTHING")
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Messages counted in the room stats, thread context and deleted messages are not
+const countedMessages = "deleted_at IS NULL AND NOT COALESCE(context, false)"
+
+// roomCorpus implements utils.Corpus over the indexed messages of a room
+type roomCorpus struct {
+	db         types.DBH
+	userbaseId string
+	roomId     string
+	docs       int
+}
+
+func newRoomCorpus(db types.DBH, userbaseId, roomId string) *roomCorpus {
+	c := &roomCorpus{db: db, userbaseId: userbaseId, roomId: roomId}
+
+	// Without stats the keywords are ranked by frequency in the message
+	db.QueryRow("SELECT docs FROM room_docs WHERE userbase_id=$1 AND room_id=$2", userbaseId, roomId).Scan(&c.docs)
+
+	return c
+}
+
+func (c *roomCorpus) Docs() int {
+	return c.docs
+}
+
+func (c *roomCorpus) DocFreqs(terms []string) map[string]int {
+	df := make(map[string]int)
+
+	rows, err := c.db.Query("SELECT term, df FROM room_terms WHERE userbase_id=$1 AND room_id=$2 AND term = ANY($3)",
+		c.userbaseId, c.roomId, pq.Array(terms))
+	if err != nil {
+		return df
+	}
+	defer rows.Close()
+
+	var term string
+	var freq int
+	for rows.Next() {
+		if err = rows.Scan(&term, &freq); err != nil {
+			break
+		}
+		df[term] = freq
+	}
+
+	return df
+}
+
+// Add accounts the terms of an indexed message in the room stats
+func (c *roomCorpus) Add(terms map[string]int) error {
+	_, err := c.db.Exec("INSERT INTO room_docs VALUES($1, $2, 1) ON CONFLICT (userbase_id, room_id) DO UPDATE SET docs = room_docs.docs + 1",
+		c.userbaseId, c.roomId)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec("INSERT INTO room_terms SELECT $1, $2, unnest($3::text[]), 1 ON CONFLICT (userbase_id, room_id, term) DO UPDATE SET df = room_terms.df + 1",
+		c.userbaseId, c.roomId, pq.Array(termKeys(terms)))
+
+	return err
+}
+
+// Remove withdraws the terms of removed messages, one list of terms per message, from the room stats
+func (c *roomCorpus) Remove(docs [][]string) error {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	df := make(map[string]int)
+	for _, terms := range docs {
+		for _, t := range terms {
+			df[t]++
+		}
+	}
+
+	var terms []string
+	var counts []int64
+	for t, n := range df {
+		terms, counts = append(terms, t), append(counts, int64(n))
+	}
+
+	_, err := c.db.Exec("UPDATE room_docs SET docs = GREATEST(docs - $3, 0) WHERE userbase_id=$1 AND room_id=$2",
+		c.userbaseId, c.roomId, len(docs))
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec("UPDATE room_terms SET df = df - t.n FROM unnest($3::text[], $4::int[]) AS t(term, n) WHERE userbase_id=$1 AND room_id=$2 AND room_terms.term = t.term",
+		c.userbaseId, c.roomId, pq.Array(terms), pq.Array(counts))
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec("DELETE FROM room_terms WHERE userbase_id=$1 AND room_id=$2 AND term = ANY($3) AND df <= 0",
+		c.userbaseId, c.roomId, pq.Array(terms))
+
+	return err
+}
+
+// termKeys lists the terms counted for a message, empty rather than nil to be stored as counted
+func termKeys(terms map[string]int) []string {
+	keys := []string{}
+	for k := range terms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// removedTerms collects the terms of the counted messages removed from each userbase and room, to withdraw them from the room stats
+type removedTerms map[[2]string][][]string
+
+// Columns returned by statements deleting messages for removedTerms.add, messages deleted before were withdrawn then
+const removedColumns = countedMessages + ", COALESCE(terms, '{}')"
+
+func (r removedTerms) add(userbaseId, roomId string, counted bool, terms []string) {
+	if counted {
+		key := [2]string{userbaseId, roomId}
+		r[key] = append(r[key], terms)
+	}
+}
+
+func (r removedTerms) withdraw(db types.DBH) error {
+	for key, docs := range r {
+		if err := newRoomCorpus(db, key[0], key[1]).Remove(docs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// roomSettings are the per room inputs of tag extraction
+type roomSettings struct {
+	vocabulary *utils.Vocabulary
+	aliases    utils.Aliases
+	corpus     *roomCorpus
+}
+
+func loadRoomSettings(db types.DBH, userbaseId, roomId string) (*roomSettings, error) {
+	vocabulary, err := loadVocabulary(db, userbaseId, roomId)
+	if err != nil {
+		return nil, types.ErrIndexer{fmt.Errorf("failed to load vocabulary with error %s", err)}
+	}
+
+	aliases, err := loadAliases(db, userbaseId, roomId)
+	if err != nil {
+		return nil, types.ErrIndexer{fmt.Errorf("failed to load aliases with error %s", err)}
+	}
+
+	return &roomSettings{vocabulary, aliases, newRoomCorpus(db, userbaseId, roomId)}, nil
+}
+
+func (s *roomSettings) options(disableHashCheck bool) utils.IndexOptions {
+	return utils.IndexOptions{
+		Pct:              tagsPerMessage,
+		MinWords:         minWordsPerMessage,
+		DisableHashCheck: disableHashCheck,
+		Corpus:           s.corpus,
+		Aliases:          s.aliases,
+		Vocabulary:       s.vocabulary,
+	}
+}
+
+func (p *indexerPlugin) Handle(u *url.URL, rmsg *types.RecvMsg) (*types.SendMsg, error) {
 	// Context: userbaseID:chatroomID
 	scope := strings.SplitN(rmsg.Context, ":", 2)
 	if len(scope) != 2 {
 		return nil, types.ErrIndexer{fmt.Errorf("missing userbase:chatroom for scope")}
 	}
 
-	// Extract tags and smart tags from message
-	tags, keywords := utils.ExtractIndexTags(rmsg.Message, tagsPerMessage, minWordsPerMessage, disableHashCheck)
+	// Deleted messages must not surface in search anymore
+	if rmsg.Event == types.EventDelete {
+		if len(rmsg.ID) == 0 {
+			return nil, nil
+		}
+		_, err := tombstoneMessages(p.db, scope[0], scope[1], "", []string{rmsg.ID})
+		return nil, err
+	}
+
+	if rmsg.Event == types.EventReaction || rmsg.Event == types.EventUnreaction {
+		return nil, countReaction(p.db, scope[0], scope[1], rmsg)
+	}
+
+	disableHashCheck, _ := strconv.ParseBool(u.Query().Get("disableHashCheck"))
+
+	outcome, d, err := p.index(scope[0], scope[1], rmsg, disableHashCheck)
+	if err != nil {
+		return nil, err
+	}
 
-	if !disableHashCheck && len(tags) == 0 {
-		return nil, nil
+	// Standing alerts are for new messages, not for edits nor imported history. They are sent without holding up the sender.
+	if outcome == outcomeIndexed && rmsg.Event == types.EventMessage {
+		notifyLater(func() { notifyAlerts(p.db, p.plugins, scope[0], scope[1], rmsg, d) })
 	}
 
-	_, err := p.db.Exec("INSERT INTO indexer VALUES($1, $2, $3, $4, $5, NOW(), $6)",
-		rmsg.Sender.ID, scope[0], scope[1], pq.Array(tags), pq.Array(keywords), rmsg.Message)
+	// Questions are often untagged, they are checked for earlier discussions unless the sender is excluded.
+	// Finding similar messages is slow in large rooms, it runs after the message is acknowledged.
+	if (outcome == outcomeIndexed || outcome == SkipNoTags) && rmsg.Event == types.EventMessage {
+		notifyLater(func() { notifyDuplicates(p.db, p.plugins, scope[0], scope[1], rmsg, d) })
+	}
 
-	return nil, err
+	return nil, nil
+}
+
+// Outcomes of indexing a message besides the skip reasons
+const (
+	outcomeIndexed   = "indexed"
+	outcomeDuplicate = "duplicate"
+)
+
+// index extracts the tags of a message and stores it, returning the outcome and the index data of the message
+func (p *indexerPlugin) index(userbaseId, roomId string, rmsg *types.RecvMsg, disableHashCheck bool) (string, *utils.IndexData, error) {
+	if len(rmsg.Message) == 0 {
+		countSkip(SkipEmpty)
+		return SkipEmpty, nil, nil
+	}
+
+	// Explicitly ignore messages from bots and excluded senders
+	rule, err := excludedSender(p.db, userbaseId, roomId, rmsg)
+	if err != nil {
+		return "", nil, types.ErrIndexer{fmt.Errorf("failed to load exclusions with error %s", err)}
+	}
+	if rule != nil {
+		reason := SkipSender
+		if rule.Pattern == utils.BotPattern {
+			reason = SkipBot
+		}
+		countSkip(reason)
+		return reason, nil, nil
+	}
+
+	// Honor the sender's preference to never index their messages
+	optedOut, err := userOptedOut(p.db, userbaseId, rmsg.Sender.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	if optedOut {
+		countSkip(SkipUser)
+		return SkipUser, nil, nil
+	}
+
+	// Extract tags and smart tags from message, keywords distinctive in the room are preferred
+	settings, err := loadRoomSettings(p.db, userbaseId, roomId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	d := utils.Index(rmsg.Message, settings.options(disableHashCheck))
+	tags, keywords, entities := d.Tags, d.Keywords, d.Entities
+	edit := rmsg.Event == types.EventEdit && len(rmsg.ID) > 0
+
+	// Messages without hash tags need keywords, unsupported languages have none
+	var context bool
+	if d.OptedOut || (len(tags) == 0 && (!disableHashCheck || len(keywords) == 0)) {
+		reason := SkipNoTags
+		if d.OptedOut {
+			reason = SkipVocabulary
+		}
+		countSkip(reason)
+
+		// Untagged messages of threads are kept as context, found by the tags of their thread only.
+		// Other edited messages no longer qualify for the index.
+		if d.OptedOut || len(threadKey(rmsg)) == 0 {
+			if edit {
+				_, err = tombstoneMessages(p.db, userbaseId, roomId, "", []string{rmsg.ID})
+			}
+			return reason, nil, err
+		}
+		context = true
+		tags, keywords, entities = nil, nil, nil
+	}
+
+	// Context does not count as a document of the room
+	terms := termKeys(d.Terms)
+	if context {
+		terms = []string{}
+	}
+
+	// Edited messages are updated in place, the terms of the original are replaced by those of the edit in the room stats
+	if edit {
+		rows, err := p.db.Query(`WITH old AS (SELECT ctid, NOT COALESCE(context, false) AS counted, COALESCE(terms, '{}') AS terms FROM indexer
+				WHERE userbase_id=$1 AND room_id=$2 AND message_id=$3 AND deleted_at IS NULL FOR UPDATE)
+			UPDATE indexer SET tags=$4, keywords=$5, entities=$6, message=$7, mentions=$8, attachments=$9, links=$10, tickets=$11, has=$12, lang=$13, context=$14, terms=$15, message_hash=md5($7), edited_at=NOW()
+				FROM old WHERE indexer.ctid=old.ctid RETURNING old.counted, old.terms`,
+			userbaseId, roomId, rmsg.ID, pq.Array(tags), pq.Array(keywords), pq.Array(entities), rmsg.Message, pq.Array(rmsg.Mentions), pq.Array(rmsg.AttachmentURLs()),
+			pq.Array(d.Links), pq.Array(d.Tickets), pq.Array(d.Has), d.Lang, context, pq.Array(terms))
+		if err != nil {
+			return "", nil, err
+		}
+
+		var count int
+		var removed = make(removedTerms)
+		for rows.Next() {
+			var counted bool
+			var old []string
+			if err = rows.Scan(&counted, pq.Array(&old)); err != nil {
+				rows.Close()
+				return "", nil, err
+			}
+			removed.add(userbaseId, roomId, counted, old)
+			count++
+		}
+		rows.Close()
+
+		// Index edits adding tags to a message which was not indexed
+		if count > 0 {
+			if err = removed.withdraw(p.db); err != nil {
+				return "", nil, err
+			}
+			if err = syncThreadTags(p.db, userbaseId, roomId, threadKey(rmsg)); err != nil {
+				return "", nil, err
+			}
+			if context {
+				return SkipNoTags, nil, nil
+			}
+			return outcomeIndexed, d, settings.corpus.Add(d.Terms)
+		}
+	}
+
+	// Prefer the time the message was sent over the time it reached us
+	var ctime interface{}
+	if !rmsg.Timestamp.IsZero() {
+		ctime = rmsg.Timestamp.UTC()
+	}
+
+	// Messages delivered again or imported twice are recognized by ID, or by sender, time and content without one.
+	// Messages without time are stamped on arrival, so a copy without ID nor time is one delivered again shortly after.
+	res, err := p.db.Exec("INSERT INTO indexer (user_id, userbase_id, room_id, tags, keywords, ctime, message, message_id, thread_id, sender_name, mentions, attachments, permalink, entities, links, tickets, has, lang, context, terms, message_hash) SELECT $1, $2, $3, $4, $5, COALESCE($6::timestamp, NOW()), $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $21, md5($7) WHERE NOT EXISTS (SELECT 1 FROM indexer WHERE userbase_id=$2 AND room_id=$3 AND (($8<>'' AND message_id=$8) OR ($8='' AND user_id=$1 AND message_hash=md5($7) AND message=$7 AND CASE WHEN $6::timestamp IS NULL THEN ctime > NOW() - $20::float8 * INTERVAL '1 second' ELSE ctime=$6::timestamp END))) ON CONFLICT (userbase_id, room_id, message_id) WHERE message_id <> '' DO NOTHING",
+		rmsg.Sender.ID, userbaseId, roomId, pq.Array(tags), pq.Array(keywords), ctime, rmsg.Message,
+		rmsg.ID, rmsg.ThreadID, rmsg.Sender.Name, pq.Array(rmsg.Mentions), pq.Array(rmsg.AttachmentURLs()), rmsg.Permalink, pq.Array(entities),
+		pq.Array(d.Links), pq.Array(d.Tickets), pq.Array(d.Has), d.Lang, context, redeliveryWindow.Seconds(), pq.Array(terms))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if count, err := res.RowsAffected(); err != nil || count == 0 {
+		return outcomeDuplicate, nil, err
+	}
+
+	if err = syncThreadTags(p.db, userbaseId, roomId, threadKey(rmsg)); err != nil {
+		return "", nil, err
+	}
+
+	if context {
+		return SkipNoTags, nil, nil
+	}
+
+	return outcomeIndexed, d, settings.corpus.Add(d.Terms)
+}
+
+// countReaction adds or removes a reaction to an indexed message, reactions to messages not indexed are dropped
+func countReaction(db types.DBH, userbaseId, roomId string, rmsg *types.RecvMsg) error {
+	if len(rmsg.ID) == 0 {
+		return nil
+	}
+
+	delta := 1
+	if rmsg.Event == types.EventUnreaction {
+		delta = -1
+	}
+
+	_, err := db.Exec("UPDATE indexer SET reactions=GREATEST(COALESCE(reactions, 0)+$4, 0) WHERE userbase_id=$1 AND room_id=$2 AND message_id=$3 AND deleted_at IS NULL",
+		userbaseId, roomId, rmsg.ID, delta)
+	if err != nil {
+		return types.ErrIndexer{fmt.Errorf("failed to count reaction with error %s", err)}
+	}
+
+	return nil
+}
+
+// threadKey is the thread of a message, a parent message keys its thread by its own ID
+func threadKey(rmsg *types.RecvMsg) string {
+	if len(rmsg.ThreadID) > 0 {
+		return rmsg.ThreadID
+	}
+
+	return rmsg.ID
+}
+
+// syncThreadTags sets the thread tags of all messages in the thread to the hash tags of its messages
+func syncThreadTags(db types.DBH, userbaseId, roomId, key string) error {
+	if len(key) == 0 {
+		return nil
+	}
+
+	_, err := db.Exec("UPDATE indexer SET thread_tags = ARRAY(SELECT DISTINCT unnest(tags) FROM indexer WHERE userbase_id=$1 AND room_id=$2 AND (thread_id=$3 OR message_id=$3) AND deleted_at IS NULL) WHERE userbase_id=$1 AND room_id=$2 AND (thread_id=$3 OR message_id=$3) AND deleted_at IS NULL",
+		userbaseId, roomId, key)
+
+	return err
 }
 
 func (p *indexerPlugin) Refresh() error {
 	return nil
 }
+
+// Clears the content of a message and marks it deleted
+const tombstone = "tags='{}', keywords='{}', entities='{}', mentions='{}', attachments='{}', links='{}', tickets='{}', has='{}', thread_tags='{}', terms='{}', message='', message_hash=NULL, deleted_at=NOW()"
+
+// tombstoneMessages deletes indexed messages by ID or permalink, limited to the messages of userId if given
+func tombstoneMessages(db types.DBH, userbaseId, roomId, userId string, messageIds []string) (int64, error) {
+	// Messages without ID or permalink store them empty, an empty ID would match them all
+	var ids []string
+	for _, id := range messageIds {
+		if len(id) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	return tombstoneWhere(db, userbaseId, roomId, "userbase_id=$1 AND room_id=$2 AND (message_id = ANY($3) OR permalink = ANY($3)) AND ($4='' OR user_id=$4) AND deleted_at IS NULL",
+		userbaseId, roomId, pq.Array(ids), userId)
+}
+
+// tombstoneLast deletes the most recent indexed message of the user in the room
+func tombstoneLast(db types.DBH, userbaseId, roomId, userId string) (int64, error) {
+	return tombstoneWhere(db, userbaseId, roomId, "ctid = (SELECT ctid FROM indexer WHERE userbase_id=$1 AND room_id=$2 AND user_id=$3 AND deleted_at IS NULL ORDER BY ctime DESC LIMIT 1)",
+		userbaseId, roomId, userId)
+}
+
+// tombstoneWhere deletes the matching messages and withdraws their tags from their threads
+func tombstoneWhere(db types.DBH, userbaseId, roomId, where string, args ...interface{}) (int64, error) {
+	// Tombstones clear the terms, they are returned as they were to withdraw them from the room stats
+	rows, err := db.Query("WITH old AS (SELECT ctid, NOT COALESCE(context, false) AS counted, COALESCE(terms, '{}') AS terms FROM indexer WHERE ("+where+") AND deleted_at IS NULL FOR UPDATE) "+
+		"UPDATE indexer SET "+tombstone+" FROM old WHERE indexer.ctid=old.ctid RETURNING COALESCE(NULLIF(thread_id, ''), message_id, ''), old.counted, old.terms", args...)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	var keys = make(map[string]bool)
+	var removed = make(removedTerms)
+	for rows.Next() {
+		var key string
+		var counted bool
+		var terms []string
+		if err = rows.Scan(&key, &counted, pq.Array(&terms)); err != nil {
+			rows.Close()
+			return count, err
+		}
+		keys[key] = true
+		removed.add(userbaseId, roomId, counted, terms)
+		count++
+	}
+	rows.Close()
+
+	if err = removed.withdraw(db); err != nil {
+		return count, err
+	}
+
+	for key := range keys {
+		if err = syncThreadTags(db, userbaseId, roomId, key); err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
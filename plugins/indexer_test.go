@@ -0,0 +1,41 @@
+package plugins
+
+import (
+	"testing"
+
+	"bitbucket.org/psyche/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoomStatsOfMessagesIndexedBefore(t *testing.T) {
+	db := testDB(t)
+	dbh := types.DBH{db}
+
+	// Messages indexed before room stats and terms were kept
+	_, err := db.Exec("CREATE TABLE indexer (user_id text, userbase_id text, room_id text, tags text[], keywords text[], ctime timestamp, message text)")
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO indexer VALUES
+		('u1', 'ub', 'room', '{deploy}', '{pipeline}', NOW() - INTERVAL '2 hours', 'deploy the pipeline #deploy'),
+		('u1', 'ub', 'room', '{deploy}', '{rollback}', NOW() - INTERVAL '1 hour', 'rollback the deploy #deploy')`)
+	require.NoError(t, err)
+
+	require.NotNil(t, NewIndexerPlugin(db, Psyches{}))
+
+	terms := []string{"deploy", "pipeline", "rollback"}
+	c := newRoomCorpus(dbh, "ub", "room")
+	require.Equal(t, 2, c.Docs())
+	require.Equal(t, map[string]int{"deploy": 2, "pipeline": 1, "rollback": 1}, c.DocFreqs(terms))
+
+	// Removing an old message withdraws the terms it was counted with only
+	count, err := tombstoneLast(dbh, "ub", "room", "u1")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+
+	c = newRoomCorpus(dbh, "ub", "room")
+	require.Equal(t, 1, c.Docs())
+	require.Equal(t, map[string]int{"deploy": 1, "pipeline": 1}, c.DocFreqs(terms))
+
+	// Existing stats are not counted again on restart
+	require.NotNil(t, NewIndexerPlugin(db, Psyches{}))
+	require.Equal(t, 1, newRoomCorpus(dbh, "ub", "room").Docs())
+}
@@ -1,15 +1,15 @@
 package plugins
 
 import (
-	"bytes"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
 
+	"bitbucket.org/psyche/adapters"
+	"bitbucket.org/psyche/signature"
 	"bitbucket.org/psyche/types"
 )
 
@@ -24,6 +24,8 @@ type registerMsg struct {
 	Key        string
 	URL        string
 	Name       string
+	Type       string
+	Secret     string
 }
 
 // Sanitize the input to extract key-value pairs
@@ -40,6 +42,12 @@ func NewRegisterPlugin(db *sql.DB, p Psyches) Psyche {
 		return nil
 	}
 
+	// Outbound adapter used to render messages posted to the room URL
+	_, err = r.db.Exec("ALTER TABLE rooms ADD COLUMN IF NOT EXISTS room_type text, ADD COLUMN IF NOT EXISTS room_secret text")
+	if err != nil {
+		return nil
+	}
+
 	// Register error stream
 	rmsg := types.RecvMsg{}
 	rmsg.Message = "url=https://botnana.domain.dev.atlassian.io/message?secret=9522becdc4600be22dcf7f6ba12bcf8b657b09f6308478db7056bcaf4c303e688c831d5e3cad8424 name=psyche_error_stream"
@@ -99,6 +107,30 @@ func (p *registerPlugin) Handle(u *url.URL, rmsg *types.RecvMsg) (smsg *types.Se
 		msg.Name = v
 	}
 
+	// Chat platform of the room URL, guessed from the URL if not explicit
+	if v, ok := options["type"]; ok {
+		if !adapters.IsOutbound(v) {
+			return nil, types.ErrRegister{Err: fmt.Errorf("unsupported room type %s", v)}
+		}
+		msg.Type = strings.ToLower(v)
+	} else {
+		msg.Type = adapters.DetectOutbound(msg.URL)
+	}
+
+	// Secrets typed in chat are read by everyone in the room, admins get them from /secret instead
+	if _, ok := options["secret"]; ok {
+		return nil, types.ErrRegister{Err: errors.New("secrets are not accepted in chat, ask an admin for the secret of the room")}
+	}
+
+	// Key for signing messages posted to the room, an existing secret is retained or else one is generated
+	err = p.db.QueryRow("SELECT COALESCE(room_secret, '') FROM rooms WHERE userbase_id=$1 AND room_id=$2", msg.UserbaseId, msg.RoomId).Scan(&msg.Secret)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if len(msg.Secret) == 0 {
+		msg.Secret = signature.NewSecret()
+	}
+
 	// Validate the URL and other inputs
 	if err := validateURL(msg); err != nil {
 		return nil, err
@@ -113,11 +145,11 @@ func (p *registerPlugin) Handle(u *url.URL, rmsg *types.RecvMsg) (smsg *types.Se
 	var res sql.Result
 
 	if len(msg.Name) == 0 {
-		res, err = p.db.Exec("UPDATE rooms SET room_key=$3, room_url=$4 WHERE userbase_id=$1 AND room_id=$2",
-			msg.UserbaseId, msg.RoomId, msg.Key, msg.URL)
+		res, err = p.db.Exec("UPDATE rooms SET room_key=$3, room_url=$4, room_type=$5, room_secret=COALESCE(NULLIF($6, ''), room_secret) WHERE userbase_id=$1 AND room_id=$2",
+			msg.UserbaseId, msg.RoomId, msg.Key, msg.URL, msg.Type, msg.Secret)
 	} else {
-		res, err = p.db.Exec("UPDATE rooms SET room_key=$3, room_url=$4, room_name=$5 WHERE userbase_id=$1 AND room_id=$2",
-			msg.UserbaseId, msg.RoomId, msg.Key, msg.URL, msg.Name)
+		res, err = p.db.Exec("UPDATE rooms SET room_key=$3, room_url=$4, room_type=$5, room_secret=COALESCE(NULLIF($6, ''), room_secret), room_name=$7 WHERE userbase_id=$1 AND room_id=$2",
+			msg.UserbaseId, msg.RoomId, msg.Key, msg.URL, msg.Type, msg.Secret, msg.Name)
 	}
 
 	if err != nil {
@@ -129,8 +161,8 @@ func (p *registerPlugin) Handle(u *url.URL, rmsg *types.RecvMsg) (smsg *types.Se
 	}
 
 	// Insert if entry does not exist
-	_, err = p.db.Exec("INSERT INTO rooms (userbase_id, room_id, room_key, room_url, room_name) SELECT $1, $2, $3, $4, $5 WHERE NOT EXISTS (SELECT 1 FROM rooms WHERE userbase_id=$1 AND room_id=$2)",
-		msg.UserbaseId, msg.RoomId, msg.Key, msg.URL, msg.Name)
+	_, err = p.db.Exec("INSERT INTO rooms (userbase_id, room_id, room_key, room_url, room_name, room_type, room_secret) SELECT $1, $2, $3, $4, $5, $6, $7 WHERE NOT EXISTS (SELECT 1 FROM rooms WHERE userbase_id=$1 AND room_id=$2)",
+		msg.UserbaseId, msg.RoomId, msg.Key, msg.URL, msg.Name, msg.Type, msg.Secret)
 
 	return nil, err
 }
@@ -139,24 +171,26 @@ func (p *registerPlugin) Refresh() error {
 	return nil
 }
 
-func validateURL(msg registerMsg) (err error) {
-	// Post the response to registered room URL
-	body := new(bytes.Buffer)
-	err = json.NewEncoder(body).Encode(types.NewSendMsg(fmt.Sprintf("Psyche room registration invoked with key %s", msg.Key)))
-	if err != nil {
-		return types.ErrRelay{Err: fmt.Errorf("failed to encode response body with error %s", err)}
-	}
+func validateURL(msg registerMsg) error {
+	// Post the response to registered room URL, signed with the secret the room will be using
+	room := &roomInfo{msg.Name, msg.URL, msg.Secret, adapters.GetOutbound(msg.Type)}
+	return deliver(room, types.NewSendMsg(fmt.Sprintf("Psyche room registration invoked with key %s", msg.Key)))
+}
 
-	resp, err := http.Post(msg.URL, "application/json", body)
-	if err == nil {
-		defer resp.Body.Close()
+// RoomSecret returns the secret signing the messages posted to a registered room, rotate replaces it with a new one.
+// Rooms registered before secrets were generated get one on first use.
+func RoomSecret(db *sql.DB, userbaseId, roomId string, rotate bool) (string, error) {
+	var secret string
+	err := db.QueryRow("SELECT COALESCE(room_secret, '') FROM rooms WHERE userbase_id=$1 AND room_id=$2", userbaseId, roomId).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return "", types.ErrRegister{Err: fmt.Errorf("room %s:%s is not registered", userbaseId, roomId)}
 	}
-
-	if err != nil {
-		err = types.ErrRelay{Err: fmt.Errorf("http post to %s failed with error %s", msg.URL, err)}
-	} else if resp.StatusCode != http.StatusOK {
-		err = types.ErrRelay{Err: fmt.Errorf("http post to %s returned error %s", msg.URL, resp.Status)}
+	if err != nil || (len(secret) > 0 && !rotate) {
+		return secret, err
 	}
 
-	return err
+	secret = signature.NewSecret()
+	_, err = db.Exec("UPDATE rooms SET room_secret=$3 WHERE userbase_id=$1 AND room_id=$2", userbaseId, roomId, secret)
+
+	return secret, err
 }
@@ -0,0 +1,307 @@
+package plugins
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"bitbucket.org/psyche/types"
+	"bitbucket.org/psyche/utils"
+	"github.com/lib/pq"
+)
+
+// Statuses of reindex jobs
+const (
+	ReindexPending   = "pending"
+	ReindexRunning   = "running"
+	ReindexDone      = "done"
+	ReindexFailed    = "failed"
+	ReindexCancelled = "cancelled"
+)
+
+// Rows recomputed per batch, progress is recorded after every batch
+const reindexBatch = 500
+
+// A running job without progress for this long was interrupted and can be resumed
+const reindexLease = 5 * time.Minute
+
+// ReindexJob recomputes the tags of indexed messages, optionally limited to a room and a time window
+type ReindexJob struct {
+	ID         int64
+	UserbaseID string
+	RoomID     string
+	Since      *time.Time
+	Until      *time.Time
+	Status     string
+
+	// Last indexer row recomputed
+	LastID    int64
+	Processed int64
+	Error     string
+	UpdatedAt time.Time
+}
+
+func (j *ReindexJob) String() string {
+	scope := "all rooms"
+	if len(j.UserbaseID) > 0 {
+		scope = j.UserbaseID + ":" + j.RoomID
+	}
+
+	window := ""
+	if j.Since != nil {
+		window += " since " + j.Since.Format(time.RFC3339)
+	}
+	if j.Until != nil {
+		window += " until " + j.Until.Format(time.RFC3339)
+	}
+
+	s := fmt.Sprintf("%d %s %s%s processed=%d", j.ID, j.Status, scope, window, j.Processed)
+	if len(j.Error) > 0 {
+		s += " error=" + j.Error
+	}
+
+	return s
+}
+
+// InitReindex creates the reindex jobs table
+func InitReindex(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS reindex_jobs (job_id bigserial PRIMARY KEY, userbase_id text, room_id text, since timestamp, until timestamp, status text, last_id bigint, processed bigint, error text, updated_at timestamp)")
+	return err
+}
+
+// CreateReindexJob queues a job for all messages, the messages of a userbase or of a room, sent within [since, until)
+func CreateReindexJob(db *sql.DB, userbaseId, roomId string, since, until *time.Time) (int64, error) {
+	if len(roomId) > 0 && len(userbaseId) == 0 {
+		return 0, types.ErrReindex{fmt.Errorf("room %s requires a userbase", roomId)}
+	}
+
+	var id int64
+	err := db.QueryRow("INSERT INTO reindex_jobs (userbase_id, room_id, since, until, status, last_id, processed, error, updated_at) VALUES($1, $2, $3, $4, $5, 0, 0, '', NOW()) RETURNING job_id",
+		userbaseId, roomId, pq.NullTime{Time: timeOrZero(since), Valid: since != nil}, pq.NullTime{Time: timeOrZero(until), Valid: until != nil}, ReindexPending).Scan(&id)
+
+	return id, err
+}
+
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+
+	return t.UTC()
+}
+
+// CancelReindexJob stops a job at its next batch
+func CancelReindexJob(db *sql.DB, id int64) error {
+	res, err := db.Exec("UPDATE reindex_jobs SET status=$2, updated_at=NOW() WHERE job_id=$1 AND status IN ($3, $4)",
+		id, ReindexCancelled, ReindexPending, ReindexRunning)
+	if err != nil {
+		return err
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		return types.ErrReindex{fmt.Errorf("no pending or running job %d", id)}
+	}
+
+	return nil
+}
+
+const reindexJobColumns = "job_id, userbase_id, room_id, since, until, status, last_id, processed, error, updated_at"
+
+func scanReindexJob(row interface{ Scan(...interface{}) error }) (*ReindexJob, error) {
+	var j ReindexJob
+	var since, until pq.NullTime
+	err := row.Scan(&j.ID, &j.UserbaseID, &j.RoomID, &since, &until, &j.Status, &j.LastID, &j.Processed, &j.Error, &j.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if since.Valid {
+		j.Since = &since.Time
+	}
+	if until.Valid {
+		j.Until = &until.Time
+	}
+
+	return &j, nil
+}
+
+// ListReindexJobs returns all jobs, most recent first
+func ListReindexJobs(db *sql.DB) ([]*ReindexJob, error) {
+	rows, err := db.Query("SELECT " + reindexJobColumns + " FROM reindex_jobs ORDER BY job_id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*ReindexJob
+	for rows.Next() {
+		j, err := scanReindexJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+
+	return jobs, rows.Err()
+}
+
+// claimReindexJob marks a pending or interrupted job as running, a zero id claims the oldest one
+func claimReindexJob(db *sql.DB, id int64) (*ReindexJob, error) {
+	row := db.QueryRow("UPDATE reindex_jobs SET status=$2, updated_at=NOW() WHERE job_id = (SELECT job_id FROM reindex_jobs WHERE ($1=0 OR job_id=$1) AND (status=$3 OR (status=$2 AND updated_at < NOW() - $4 * INTERVAL '1 second')) ORDER BY job_id LIMIT 1 FOR UPDATE SKIP LOCKED) RETURNING "+reindexJobColumns,
+		id, ReindexRunning, ReindexPending, int(reindexLease.Seconds()))
+
+	j, err := scanReindexJob(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return j, err
+}
+
+// RunReindexJob runs a pending or interrupted job to completion, resuming after the last recorded batch.
+// A zero id runs the oldest such job. Returns nil without a job to run.
+func RunReindexJob(db *sql.DB, id int64) (*ReindexJob, error) {
+	j, err := claimReindexJob(db, id)
+	if err != nil || j == nil {
+		return j, err
+	}
+
+	err = runReindexJob(types.DBH{db}, j)
+
+	status, msg := ReindexDone, ""
+	if err != nil {
+		status, msg = ReindexFailed, err.Error()
+	}
+
+	// A cancelled job keeps its status
+	res, uerr := db.Exec("UPDATE reindex_jobs SET status=$2, error=$3, updated_at=NOW() WHERE job_id=$1 AND status=$4",
+		j.ID, status, msg, ReindexRunning)
+	if err == nil {
+		err = uerr
+	}
+	if uerr != nil {
+		return j, err
+	}
+
+	j.Status, j.Error = status, msg
+	if count, _ := res.RowsAffected(); count == 0 {
+		j.Status = ReindexCancelled
+	}
+
+	return j, err
+}
+
+type reindexRow struct {
+	id                                  int64
+	userbaseId, roomId, threadKey, text string
+
+	// Terms counted in the room stats when the message was indexed
+	terms []string
+}
+
+func runReindexJob(db types.DBH, j *ReindexJob) error {
+	since := pq.NullTime{Time: timeOrZero(j.Since), Valid: j.Since != nil}
+	until := pq.NullTime{Time: timeOrZero(j.Until), Valid: j.Until != nil}
+
+	for {
+		// Thread context stays without tags of its own
+		rows, err := db.Query("SELECT id, userbase_id, room_id, COALESCE(NULLIF(thread_id, ''), message_id, ''), message, COALESCE(terms, '{}') FROM indexer WHERE id > $1 AND deleted_at IS NULL AND NOT COALESCE(context, false) AND cardinality(COALESCE(tags, '{}') || COALESCE(keywords, '{}')) > 0 AND ($2='' OR userbase_id=$2) AND ($3='' OR room_id=$3) AND ($4::timestamp IS NULL OR ctime >= $4) AND ($5::timestamp IS NULL OR ctime < $5) ORDER BY id LIMIT $6",
+			j.LastID, j.UserbaseID, j.RoomID, since, until, reindexBatch)
+		if err != nil {
+			return err
+		}
+
+		var batch []reindexRow
+		for rows.Next() {
+			var r reindexRow
+			if err = rows.Scan(&r.id, &r.userbaseId, &r.roomId, &r.threadKey, &r.text, pq.Array(&r.terms)); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		// Settings are loaded once per room and batch
+		settings := make(map[string]*roomSettings)
+		for _, r := range batch {
+			key := r.userbaseId + ":" + r.roomId
+			s, ok := settings[key]
+			if !ok {
+				if s, err = loadRoomSettings(db, r.userbaseId, r.roomId); err != nil {
+					return err
+				}
+				settings[key] = s
+			}
+
+			if err = reindexMessage(db, s, r); err != nil {
+				return err
+			}
+		}
+
+		j.LastID = batch[len(batch)-1].id
+		j.Processed += int64(len(batch))
+
+		res, err := db.Exec("UPDATE reindex_jobs SET last_id=$2, processed=$3, updated_at=NOW() WHERE job_id=$1 AND status=$4",
+			j.ID, j.LastID, j.Processed, ReindexRunning)
+		if err != nil {
+			return err
+		}
+
+		// Cancelled meanwhile
+		if count, _ := res.RowsAffected(); count == 0 {
+			return nil
+		}
+	}
+}
+
+// reindexMessage recomputes the tags of a stored message, replacing its terms in the room stats
+func reindexMessage(db types.DBH, s *roomSettings, r reindexRow) error {
+	// Stored messages were accepted by the indexer, the hash tag check is not applied again
+	opts := s.options(true)
+	opts.MinWords = 0
+
+	d := utils.Index(r.text, opts)
+	if d.OptedOut {
+		_, err := tombstoneWhere(db, r.userbaseId, r.roomId, "id=$1", r.id)
+		return err
+	}
+
+	_, err := db.Exec("UPDATE indexer SET tags=$2, keywords=$3, entities=$4, links=$5, tickets=$6, has=$7, lang=$8, terms=$9 WHERE id=$1",
+		r.id, pq.Array(d.Tags), pq.Array(d.Keywords), pq.Array(d.Entities), pq.Array(d.Links), pq.Array(d.Tickets), pq.Array(d.Has), d.Lang, pq.Array(termKeys(d.Terms)))
+	if err != nil {
+		return err
+	}
+
+	if err = s.corpus.Remove([][]string{r.terms}); err != nil {
+		return err
+	}
+	if err = s.corpus.Add(d.Terms); err != nil {
+		return err
+	}
+
+	return syncThreadTags(db, r.userbaseId, r.roomId, r.threadKey)
+}
+
+// StartReindexer runs queued and interrupted reindex jobs in the background, checking for jobs at every interval
+func StartReindexer(db *sql.DB, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			for {
+				j, err := RunReindexJob(db, 0)
+				if err != nil {
+					log.Printf("reindex job failed with error %s", err)
+				}
+				if j == nil || err != nil {
+					break
+				}
+				log.Printf("reindex job %s", j)
+			}
+		}
+	}()
+}
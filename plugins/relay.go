@@ -3,12 +3,14 @@ package plugins
 import (
 	"bytes"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"sync"
 
+	"bitbucket.org/psyche/adapters"
+	"bitbucket.org/psyche/httpclient"
+	"bitbucket.org/psyche/signature"
 	"bitbucket.org/psyche/types"
 )
 
@@ -19,8 +21,10 @@ type relayPlugin struct {
 }
 
 type roomInfo struct {
-	name string
-	url  string
+	name     string
+	url      string
+	secret   string
+	outbound adapters.Outbound
 }
 
 // NewRelayPlugin returns an instance of message relay Psyche implementation
@@ -68,18 +72,23 @@ func (p *relayPlugin) Refresh() error {
 		return nil
 	}
 
-	rows, err := p.db.Query("SELECT room_key, room_url, room_name FROM rooms")
+	rows, err := p.db.Query("SELECT room_key, room_url, room_name, COALESCE(room_type, ''), COALESCE(room_secret, '') FROM rooms")
 	if err != nil {
 		return err
 	}
 
-	var room_key, room_url, room_name string
+	var room_key, room_url, room_name, room_type, room_secret string
 	for rows.Next() {
-		if err = rows.Scan(&room_key, &room_url, &room_name); err != nil {
+		if err = rows.Scan(&room_key, &room_url, &room_name, &room_type, &room_secret); err != nil {
 			return err
 		}
 
-		p.roomMapping.Store(room_key, &roomInfo{room_name, room_url})
+		// Rooms registered before adapters were introduced have no type
+		if len(room_type) == 0 {
+			room_type = adapters.DetectOutbound(room_url)
+		}
+
+		p.roomMapping.Store(room_key, &roomInfo{room_name, room_url, room_secret, adapters.GetOutbound(room_type)})
 	}
 
 	return rows.Close()
@@ -104,19 +113,49 @@ func (p *relayPlugin) RelayMsg(rmsg *types.RecvMsg, target string, smsg *types.S
 		return types.ErrRelay{fmt.Errorf("target room mapping typecasting failed for %s", target)}
 	}
 
-	// Prepare response for POST
-	body := new(bytes.Buffer)
-	err := json.NewEncoder(body).Encode(smsg)
+	return deliver(room, smsg)
+}
+
+// RoomName returns the name of a registered room, empty if not registered
+func (p *relayPlugin) RoomName(key string) string {
+	if val, ok := p.roomMapping.Load(key); ok {
+		if room, ok := val.(*roomInfo); ok {
+			return room.name
+		}
+	}
+
+	return ""
+}
+
+// SendTo posts the message to the target room only, without falling back to the room of a request
+func (p *relayPlugin) SendTo(target string, smsg *types.SendMsg) error {
+	val, ok := p.roomMapping.Load(target)
+	if !ok {
+		return types.ErrRelay{fmt.Errorf("target room mapping missing for %s", target)}
+	}
+
+	room, ok := val.(*roomInfo)
+	if !ok {
+		return types.ErrRelay{fmt.Errorf("target room mapping typecasting failed for %s", target)}
+	}
+
+	return deliver(room, smsg)
+}
+
+// deliver posts the message to the room URL in the room format, signed with the room secret
+func deliver(room *roomInfo, smsg *types.SendMsg) error {
+	body, err := room.outbound.Encode(smsg)
 	if err != nil {
 		return types.ErrRelay{fmt.Errorf("failed to encode response body with error %s", err)}
 	}
 
-	// Post the response to registered room URL
-	resp, err := http.Post(room.url, "application/json", body)
+	req, err := http.NewRequest("POST", room.url, bytes.NewReader(body))
 	if err != nil {
 		return types.ErrRelay{fmt.Errorf("http post to %s failed with error %s", room.url, err)}
 	}
-	resp.Body.Close()
+	req.Header.Set("Content-Type", "application/json")
+	signature.SignRequest(req, room.secret, body)
 
-	return nil
+	// Post the response to registered room URL
+	return httpclient.Default.Do(req)
 }
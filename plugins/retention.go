@@ -0,0 +1,328 @@
+package plugins
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/psyche/types"
+	"github.com/lib/pq"
+)
+
+type retentionPlugin struct {
+	db      types.DBH
+	plugins Psyches
+}
+
+// Retention modes
+const (
+	// Expire all messages
+	RetainNone = "all"
+	// Expire messages indexed only by enrichment keywords, keep messages with hash tags
+	RetainTagged = "keep-tagged"
+)
+
+// Rows deleted per statement by the janitor to keep locks short
+const janitorBatch = 1000
+
+// Days untagged messages are kept as thread context waiting for a tagged reply
+const threadContextDays = 7
+
+// Shortest retention set in chat, shorter policies are set with the admin command
+const MinRetentionDays = 30
+
+// RetentionAdmins are the senders, as userbase:user, allowed to set the policy of all rooms of their userbase in chat. It is set at startup.
+var RetentionAdmins = make(map[string]bool)
+
+// NewRetentionPlugin creates an instance of retention plugin implementing Psyche interface
+func NewRetentionPlugin(db *sql.DB, p Psyches) Psyche {
+	r := &retentionPlugin{types.DBH{db}, p}
+
+	if err := InitRetention(db); err != nil {
+		return nil
+	}
+
+	return r
+}
+
+// InitRetention creates the retention policy and archive tables
+func InitRetention(db *sql.DB) error {
+	// Empty room_id applies to rooms in the userbase without a policy of their own
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS retention (userbase_id text, room_id text, days int, mode text, archive boolean, PRIMARY KEY (userbase_id, room_id))")
+	if err != nil {
+		return err
+	}
+
+	// Archived rows are stored as JSON to outlive changes to the indexer table
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS indexer_archive (archived_at timestamp, userbase_id text, room_id text, user_id text, row jsonb)")
+
+	return err
+}
+
+// Handle sets the retention policy of a room with "days=90 mode=all|keep-tagged archive=true|false", at least MinRetentionDays.
+// "off" removes the policy. Providing scope=userbase in the query URL sets the policy of all rooms in the userbase, for RetentionAdmins only.
+func (p *retentionPlugin) Handle(u *url.URL, rmsg *types.RecvMsg) (*types.SendMsg, error) {
+	// Context: userbaseID:chatroomID
+	scope := strings.SplitN(rmsg.Context, ":", 2)
+	if len(scope) != 2 {
+		return nil, types.ErrRetention{fmt.Errorf("missing userbase:chatroom for scope")}
+	}
+
+	val, ok := p.plugins["relay"]
+	if !ok {
+		return nil, types.ErrRetention{errors.New("failed to get relay plugin")}
+	}
+
+	relay, ok := val.(*relayPlugin)
+	if !ok {
+		return nil, types.ErrRetention{errors.New("failed to cast relay plugin interface")}
+	}
+
+	// Policies of the userbase expire the messages of every room in it
+	roomId := scope[1]
+	if u.Query().Get("scope") == "userbase" {
+		if !RetentionAdmins[scope[0]+":"+rmsg.Sender.ID] {
+			return nil, types.ErrRetention{errors.New("only admins set the retention policy of the userbase")}
+		}
+		roomId = ""
+	}
+
+	var reply string
+	if strings.TrimSpace(strings.ToLower(rmsg.Message)) == "off" {
+		if err := RemoveRetention(p.db.DB, scope[0], roomId); err != nil {
+			return nil, err
+		}
+		reply = "retention policy removed, messages are kept forever"
+	} else {
+		var options = make(map[string]string)
+		for _, f := range strings.Fields(sanitizeInputRx.ReplaceAllString(rmsg.Message, "=")) {
+			if kv := strings.SplitN(f, "=", 2); len(kv) == 2 {
+				options[strings.ToLower(kv[0])] = kv[1]
+			}
+		}
+
+		days, err := strconv.Atoi(options["days"])
+		if err != nil || days <= 0 {
+			return nil, types.ErrRetention{fmt.Errorf("missing or invalid days in %s", rmsg.Message)}
+		}
+		if days < MinRetentionDays {
+			return nil, types.ErrRetention{fmt.Errorf("messages are kept at least %d days", MinRetentionDays)}
+		}
+
+		mode := options["mode"]
+		if len(mode) == 0 {
+			mode = RetainNone
+		}
+		archive, _ := strconv.ParseBool(options["archive"])
+
+		if err = SetRetention(p.db.DB, scope[0], roomId, days, mode, archive); err != nil {
+			return nil, err
+		}
+		reply = fmt.Sprintf("messages older than %d days expire, mode=%s archive=%t", days, mode, archive)
+	}
+
+	return nil, relay.RelayMsg(rmsg, u.Query().Get("target"), types.NewSendMsg(reply))
+}
+
+func (p *retentionPlugin) Refresh() error {
+	return nil
+}
+
+// SetRetention sets the retention policy of a room, or of the userbase if roomId is empty
+func SetRetention(db *sql.DB, userbaseId, roomId string, days int, mode string, archive bool) error {
+	if mode != RetainNone && mode != RetainTagged {
+		return types.ErrRetention{fmt.Errorf("unknown retention mode %s", mode)}
+	}
+
+	_, err := db.Exec("INSERT INTO retention VALUES($1, $2, $3, $4, $5) ON CONFLICT (userbase_id, room_id) DO UPDATE SET days=$3, mode=$4, archive=$5",
+		userbaseId, roomId, days, mode, archive)
+
+	return err
+}
+
+// RemoveRetention removes the retention policy of a room, or of the userbase if roomId is empty
+func RemoveRetention(db *sql.DB, userbaseId, roomId string) error {
+	_, err := db.Exec("DELETE FROM retention WHERE userbase_id=$1 AND room_id=$2", userbaseId, roomId)
+	return err
+}
+
+// ForgetUser removes all indexed and archived messages, saved searches and preferences of a user in the userbase, except asking never to be indexed
+func ForgetUser(db *sql.DB, userbaseId, userId string) (int64, error) {
+	rows, err := db.Query("DELETE FROM indexer WHERE userbase_id=$1 AND user_id=$2 RETURNING room_id, COALESCE(NULLIF(thread_id, ''), message_id, ''), "+removedColumns, userbaseId, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	// Withdraw the tags of the user from the threads they took part in, and their terms from the room stats
+	var count int64
+	var threads = make(map[[2]string]bool)
+	var removed = make(removedTerms)
+	for rows.Next() {
+		var t [2]string
+		var counted bool
+		var terms []string
+		if err = rows.Scan(&t[0], &t[1], &counted, pq.Array(&terms)); err != nil {
+			rows.Close()
+			return count, err
+		}
+		threads[t] = true
+		removed.add(userbaseId, t[0], counted, terms)
+		count++
+	}
+	rows.Close()
+
+	if err = removed.withdraw(types.DBH{db}); err != nil {
+		return count, err
+	}
+
+	for t := range threads {
+		if err = syncThreadTags(types.DBH{db}, userbaseId, t[0], t[1]); err != nil {
+			return count, err
+		}
+	}
+
+	_, err = db.Exec("DELETE FROM indexer_archive WHERE userbase_id=$1 AND user_id=$2", userbaseId, userId)
+	if err != nil {
+		return count, err
+	}
+
+	// Saved searches exist only with the saved plugin enabled
+	var saved bool
+	if err = db.QueryRow("SELECT to_regclass('saved_searches') IS NOT NULL").Scan(&saved); err != nil {
+		return count, err
+	}
+	if saved {
+		if _, err = db.Exec("DELETE FROM saved_searches WHERE userbase_id=$1 AND user_id=$2", userbaseId, userId); err != nil {
+			return count, err
+		}
+	}
+
+	// Forgetting must not index the user again, a noindex preference is kept
+	_, err = db.Exec("DELETE FROM user_prefs WHERE userbase_id=$1 AND user_id=$2 AND NOT COALESCE(noindex, false)", userbaseId, userId)
+
+	return count, err
+}
+
+// Deletes a batch of expired rows of a policy, a userbase policy skips rooms with a policy of their own
+const expireQuery = `SELECT ctid FROM indexer WHERE userbase_id=$1
+	AND ((room_id=$2 AND $2<>'') OR ($2='' AND room_id NOT IN (SELECT room_id FROM retention WHERE userbase_id=$1 AND room_id<>'')))
+	AND ctime < NOW() - $3 * INTERVAL '1 day'
+	AND ($4='` + RetainNone + `' OR cardinality(COALESCE(tags, '{}'))=0 OR deleted_at IS NOT NULL)
+	LIMIT $5`
+
+// ExpireMessages applies all retention policies once and returns the number of expired rows
+func ExpireMessages(db *sql.DB) (int64, error) {
+	rows, err := db.Query("SELECT userbase_id, room_id, days, mode, archive FROM retention")
+	if err != nil {
+		return 0, err
+	}
+
+	type policy struct {
+		userbaseId, roomId, mode string
+		days                     int
+		archive                  bool
+	}
+
+	var policies []policy
+	for rows.Next() {
+		var p policy
+		if err = rows.Scan(&p.userbaseId, &p.roomId, &p.days, &p.mode, &p.archive); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		policies = append(policies, p)
+	}
+	rows.Close()
+
+	// Expired messages withdraw their terms from the room stats
+	var total int64
+	for _, p := range policies {
+		query := "DELETE FROM indexer WHERE ctid IN (" + expireQuery + ") RETURNING room_id, " + removedColumns
+		if p.archive {
+			query = "WITH moved AS (DELETE FROM indexer WHERE ctid IN (" + expireQuery + ") RETURNING *), " +
+				"archived AS (INSERT INTO indexer_archive SELECT NOW(), userbase_id, room_id, user_id, to_jsonb(moved) FROM moved) " +
+				"SELECT room_id, " + removedColumns + " FROM moved"
+		}
+
+		// Expire in batches until a partial batch is left
+		for {
+			count, err := expireBatch(db, p.userbaseId, query, p.userbaseId, p.roomId, p.days, p.mode, janitorBatch)
+			total += count
+			if err != nil {
+				return total, err
+			}
+			if count < janitorBatch {
+				break
+			}
+		}
+	}
+
+	// Thread context no tagged message of the thread refers to, messages left without tags otherwise are kept
+	for {
+		res, err := db.Exec(`DELETE FROM indexer WHERE ctid IN (SELECT ctid FROM indexer WHERE context
+			AND cardinality(COALESCE(thread_tags, '{}'))=0
+			AND deleted_at IS NULL AND ctime < NOW() - $1 * INTERVAL '1 day' LIMIT $2)`, threadContextDays, janitorBatch)
+		if err != nil {
+			return total, err
+		}
+
+		count, _ := res.RowsAffected()
+		total += count
+		if count < janitorBatch {
+			break
+		}
+	}
+
+	return total, nil
+}
+
+// expireBatch runs a query deleting a batch of messages of the userbase, returning the room and removedColumns of each
+func expireBatch(db *sql.DB, userbaseId, query string, args ...interface{}) (int64, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	var removed = make(removedTerms)
+	for rows.Next() {
+		var roomId string
+		var counted bool
+		var terms []string
+		if err = rows.Scan(&roomId, &counted, pq.Array(&terms)); err != nil {
+			rows.Close()
+			return count, err
+		}
+		removed.add(userbaseId, roomId, counted, terms)
+		count++
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return count, err
+	}
+
+	return count, removed.withdraw(types.DBH{db})
+}
+
+// StartJanitor expires messages and stored exports in the background at every interval
+func StartJanitor(db *sql.DB, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			count, err := ExpireMessages(db)
+			if err != nil {
+				log.Printf("janitor failed after expiring %d messages with error %s", count, err)
+			} else if count > 0 {
+				log.Printf("janitor expired %d messages", count)
+			}
+
+			if n, err := ExpireExports(); err != nil {
+				log.Printf("janitor failed after removing %d exports with error %s", n, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,363 @@
+package plugins
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"bitbucket.org/psyche/types"
+	"bitbucket.org/psyche/utils"
+)
+
+type savedPlugin struct {
+	db      types.DBH
+	plugins Psyches
+}
+
+// Quiet hours as 22:00-07:00
+var quietHoursRx = regexp.MustCompile(`^([01]?[0-9]|2[0-3]):([0-5][0-9])-([01]?[0-9]|2[0-3]):([0-5][0-9])$`)
+
+// NewSavedPlugin creates an instance of saved search plugin implementing Psyche interface
+func NewSavedPlugin(db *sql.DB, p Psyches) Psyche {
+	r := &savedPlugin{types.DBH{db}, p}
+
+	// Searches are saved per user in the room they were saved in, muted_until 'infinity' mutes until unmuted
+	_, err := r.db.Exec("CREATE TABLE IF NOT EXISTS saved_searches (userbase_id text, user_id text, name text, room_id text, query text, alert boolean, muted_until timestamp, quiet_from text, quiet_to text, tz text, PRIMARY KEY (userbase_id, user_id, name))")
+	if err != nil {
+		return nil
+	}
+
+	return r
+}
+
+// Handle manages the saved searches of the sender with the commands:
+//
+//	save name query                     save a query run in the room
+//	run name                            run a saved query
+//	alert name on|off                   notify matching new messages
+//	mute name [duration]                pause notifications, until unmuted without duration
+//	unmute name                         resume notifications
+//	quiet name 22:00-07:00 [zone]|off   no notifications during the hours, UTC by default
+//	remove name                         remove a saved query
+//	list                                list saved queries
+//
+// Replies and notifications are sent to the room registered by the user in the absence of an explicit target.
+func (p *savedPlugin) Handle(u *url.URL, rmsg *types.RecvMsg) (*types.SendMsg, error) {
+	// Context: userbaseID:chatroomID
+	scope := strings.SplitN(rmsg.Context, ":", 2)
+	if len(scope) != 2 {
+		return nil, types.ErrSaved{fmt.Errorf("missing userbase:chatroom for scope")}
+	}
+
+	val, ok := p.plugins["relay"]
+	if !ok {
+		return nil, types.ErrSaved{errors.New("failed to get relay plugin")}
+	}
+
+	relay, ok := val.(*relayPlugin)
+	if !ok {
+		return nil, types.ErrSaved{errors.New("failed to cast relay plugin interface")}
+	}
+
+	target := u.Query().Get("target")
+	if len(target) == 0 {
+		// Look for user registered room for sending messages (UserbaseId:AAID)
+		target = scope[0] + ":" + rmsg.Sender.ID
+	}
+
+	fields := strings.Fields(rmsg.Message)
+	if len(fields) == 0 {
+		fields = []string{"list"}
+	}
+
+	var name string
+	if len(fields) > 1 {
+		name = strings.ToLower(fields[1])
+	}
+	if len(name) == 0 && strings.ToLower(fields[0]) != "list" {
+		return nil, types.ErrSaved{fmt.Errorf("missing saved search name in %s", rmsg.Message)}
+	}
+
+	var reply string
+	var err error
+	switch strings.ToLower(fields[0]) {
+	case "save":
+		reply, err = p.save(scope[0], scope[1], rmsg.Sender.ID, name, strings.Join(fields[2:], " "))
+	case "run":
+		reply, err = p.run(scope[0], rmsg.Sender.ID, name)
+	case "alert":
+		reply, err = p.alert(scope[0], rmsg.Sender.ID, name, fields[2:])
+	case "mute":
+		reply, err = p.mute(scope[0], rmsg.Sender.ID, name, fields[2:])
+	case "unmute":
+		reply, err = p.update(scope[0], rmsg.Sender.ID, name, "muted_until=NULL", nil, "alert "+name+" unmuted")
+	case "quiet":
+		reply, err = p.quiet(scope[0], rmsg.Sender.ID, name, fields[2:])
+	case "remove":
+		reply, err = p.update(scope[0], rmsg.Sender.ID, name, "", nil, "search "+name+" removed")
+	case "list":
+		reply, err = p.list(scope[0], rmsg.Sender.ID)
+	default:
+		return nil, types.ErrSaved{fmt.Errorf("unknown command %s", fields[0])}
+	}
+
+	if err != nil || len(reply) == 0 {
+		return nil, err
+	}
+
+	return nil, relay.RelayMsg(rmsg, target, types.NewSendMsg(reply))
+}
+
+func (p *savedPlugin) save(userbaseId, roomId, userId, name, query string) (string, error) {
+	q, err := loadQuery(p.db, userbaseId, roomId, query)
+	if err != nil {
+		return "", err
+	}
+	if q.Empty() {
+		return "", types.ErrSaved{fmt.Errorf("missing search terms for %s", name)}
+	}
+
+	_, err = p.db.Exec("INSERT INTO saved_searches (userbase_id, user_id, name, room_id, query, alert) VALUES($1, $2, $3, $4, $5, false) ON CONFLICT (userbase_id, user_id, name) DO UPDATE SET room_id=$4, query=$5",
+		userbaseId, userId, name, roomId, query)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("saved search %s: %s", name, query), nil
+}
+
+func (p *savedPlugin) run(userbaseId, userId, name string) (string, error) {
+	var roomId, query string
+	err := p.db.QueryRow("SELECT room_id, query FROM saved_searches WHERE userbase_id=$1 AND user_id=$2 AND name=$3",
+		userbaseId, userId, name).Scan(&roomId, &query)
+	if err == sql.ErrNoRows {
+		return "", types.ErrSaved{fmt.Errorf("no saved search %s", name)}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	val, ok := p.plugins["search"]
+	if !ok {
+		return "", types.ErrSaved{errors.New("failed to get search plugin")}
+	}
+
+	search, ok := val.(*searchPlugin)
+	if !ok {
+		return "", types.ErrSaved{errors.New("failed to cast search plugin interface")}
+	}
+
+	reply, err := search.search(userbaseId, roomId, "", query, SearchRanking, &resultFormat{format: formatText, length: snippetLength})
+	if err != nil || len(reply) > 0 {
+		return reply, err
+	}
+
+	return fmt.Sprintf("no results for %s: %s", name, query), nil
+}
+
+func (p *savedPlugin) alert(userbaseId, userId, name string, args []string) (string, error) {
+	on := len(args) == 0 || strings.ToLower(args[0]) != "off"
+
+	reply := "alert " + name + " off"
+	if on {
+		reply = "alert " + name + " on, matching new messages are notified"
+	}
+
+	return p.update(userbaseId, userId, name, "alert=$4", []interface{}{on}, reply)
+}
+
+func (p *savedPlugin) mute(userbaseId, userId, name string, args []string) (string, error) {
+	if len(args) == 0 {
+		return p.update(userbaseId, userId, name, "muted_until='infinity'", nil, "alert "+name+" muted until unmuted")
+	}
+
+	d, err := time.ParseDuration(args[0])
+	if err != nil || d <= 0 {
+		return "", types.ErrSaved{fmt.Errorf("invalid mute duration %s", args[0])}
+	}
+
+	until := time.Now().UTC().Add(d)
+	return p.update(userbaseId, userId, name, "muted_until=$4", []interface{}{until},
+		fmt.Sprintf("alert %s muted until %s", name, until.Format(time.RFC3339)))
+}
+
+func (p *savedPlugin) quiet(userbaseId, userId, name string, args []string) (string, error) {
+	if len(args) == 0 || strings.ToLower(args[0]) == "off" {
+		return p.update(userbaseId, userId, name, "quiet_from=NULL, quiet_to=NULL, tz=NULL", nil, "alert "+name+" has no quiet hours")
+	}
+
+	m := quietHoursRx.FindStringSubmatch(args[0])
+	if m == nil {
+		return "", types.ErrSaved{fmt.Errorf("invalid quiet hours %s, expected 22:00-07:00", args[0])}
+	}
+
+	tz := "UTC"
+	if len(args) > 1 {
+		tz = args[1]
+	}
+	if _, err := time.LoadLocation(tz); err != nil {
+		return "", types.ErrSaved{fmt.Errorf("unknown time zone %s", tz)}
+	}
+
+	from, to := m[1]+":"+m[2], m[3]+":"+m[4]
+	return p.update(userbaseId, userId, name, "quiet_from=$4, quiet_to=$5, tz=$6", []interface{}{from, to, tz},
+		fmt.Sprintf("alert %s quiet from %s to %s %s", name, from, to, tz))
+}
+
+// update sets the columns of a saved search, or removes it without columns
+func (p *savedPlugin) update(userbaseId, userId, name, set string, args []interface{}, reply string) (string, error) {
+	query := "DELETE FROM saved_searches WHERE userbase_id=$1 AND user_id=$2 AND name=$3"
+	if len(set) > 0 {
+		query = "UPDATE saved_searches SET " + set + " WHERE userbase_id=$1 AND user_id=$2 AND name=$3"
+	}
+
+	res, err := p.db.Exec(query, append([]interface{}{userbaseId, userId, name}, args...)...)
+	if err != nil {
+		return "", err
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		return "", types.ErrSaved{fmt.Errorf("no saved search %s", name)}
+	}
+
+	return reply, nil
+}
+
+func (p *savedPlugin) list(userbaseId, userId string) (string, error) {
+	rows, err := p.db.Query("SELECT name, query, alert, COALESCE(muted_until > NOW(), false), COALESCE(quiet_from || '-' || quiet_to || ' ' || tz, '') FROM saved_searches WHERE userbase_id=$1 AND user_id=$2 ORDER BY name",
+		userbaseId, userId)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var buff bytes.Buffer
+	for rows.Next() {
+		var name, query, quiet string
+		var alert, muted bool
+		if err = rows.Scan(&name, &query, &alert, &muted, &quiet); err != nil {
+			return "", err
+		}
+
+		buff.WriteString(fmt.Sprintf("%s: %s", name, query))
+		if alert {
+			buff.WriteString(" [alert")
+			if muted {
+				buff.WriteString(", muted")
+			}
+			if len(quiet) > 0 {
+				buff.WriteString(", quiet " + quiet)
+			}
+			buff.WriteString("]")
+		}
+		buff.WriteString("\n")
+	}
+
+	if buff.Len() == 0 {
+		return "no saved searches", nil
+	}
+
+	return "saved searches:\n" + buff.String(), nil
+}
+
+func (p *savedPlugin) Refresh() error {
+	return nil
+}
+
+// inQuietHours reports if the time falls within the quiet hours in the time zone, hours may span midnight
+func inQuietHours(from, to, tz string, now time.Time) bool {
+	if len(from) == 0 || len(to) == 0 {
+		return false
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	t := now.In(loc).Format("15:04")
+	from, to = padClock(from), padClock(to)
+	if from <= to {
+		return t >= from && t < to
+	}
+
+	return t >= from || t < to
+}
+
+// padClock zero pads the hour for clock times to compare as strings: 7:00 -> 07:00
+func padClock(c string) string {
+	if len(c) == 4 {
+		return "0" + c
+	}
+
+	return c
+}
+
+// notifyAlerts sends a newly indexed message to the users with a standing alert matching it in the room.
+// Failures are logged, alerts never fail indexing.
+func notifyAlerts(db types.DBH, plugins Psyches, userbaseId, roomId string, rmsg *types.RecvMsg, d *utils.IndexData) {
+	relay, ok := plugins["relay"].(*relayPlugin)
+	if !ok {
+		return
+	}
+
+	// Senders are not notified of their own messages
+	rows, err := db.Query("SELECT user_id, name, query, COALESCE(quiet_from, ''), COALESCE(quiet_to, ''), COALESCE(tz, '') FROM saved_searches WHERE userbase_id=$1 AND room_id=$2 AND alert AND user_id<>$3 AND (muted_until IS NULL OR muted_until < NOW())",
+		userbaseId, roomId, rmsg.Sender.ID)
+	if err != nil {
+		// Rooms without the saved plugin
+		return
+	}
+
+	type alert struct {
+		userId, name, query, from, to, tz string
+	}
+
+	var alerts []alert
+	for rows.Next() {
+		var a alert
+		if err = rows.Scan(&a.userId, &a.name, &a.query, &a.from, &a.to, &a.tz); err != nil {
+			break
+		}
+		alerts = append(alerts, a)
+	}
+	rows.Close()
+
+	if len(alerts) == 0 {
+		return
+	}
+
+	vocabulary, err := loadVocabulary(db, userbaseId, roomId)
+	if err != nil {
+		log.Printf("alerts failed to load vocabulary with error %s", err)
+		return
+	}
+
+	aliases, err := loadAliases(db, userbaseId, roomId)
+	if err != nil {
+		log.Printf("alerts failed to load aliases with error %s", err)
+		return
+	}
+
+	now := time.Now()
+	for _, a := range alerts {
+		if inQuietHours(a.from, a.to, a.tz, now) || !parseQuery(a.query, vocabulary, aliases).Match(d) {
+			continue
+		}
+
+		text := fmt.Sprintf("alert %s: %s >\n%s\n", a.name, rmsg.SenderName(), rmsg.Message)
+		if len(rmsg.Permalink) > 0 {
+			text += rmsg.Permalink + "\n"
+		}
+
+		if err = relay.SendTo(userbaseId+":"+a.userId, types.NewSendMsg(text)); err != nil {
+			log.Printf("alert %s of %s failed with error %s", a.name, a.userId, err)
+		}
+	}
+}
@@ -6,7 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"bitbucket.org/psyche/types"
 	"bitbucket.org/psyche/utils"
@@ -21,6 +24,268 @@ type searchPlugin struct {
 // Limit the number of search results to prevent clogging output
 const resultLimit = 50
 
+// Replies shown with the parent of a thread, replies matching the query first
+const threadReplies = 3
+
+// Messages of a thread considered for the replies shown
+const threadScan = 100
+
+// Columns of search hits, the thread of a parent message is keyed by its own message ID
+const hitColumns = "COALESCE(message_id, ''), COALESCE(NULLIF(thread_id, ''), message_id, ''), ctime, message, COALESCE(NULLIF(sender_name, ''), user_id), COALESCE(permalink, '')"
+
+type searchHit struct {
+	messageId string
+	threadKey string
+	ctime     time.Time
+	message   string
+	sender    string
+	permalink string
+
+	// Parts of the score of messages matching the query, thread messages shown along are not ranked
+	ranked         bool
+	tagMatches     int
+	keywordMatches int
+	ageDays        float64
+	reactions      int
+}
+
+func scanHits(rows *sql.Rows) ([]*searchHit, error) {
+	defer rows.Close()
+
+	var hits []*searchHit
+	for rows.Next() {
+		h := &searchHit{}
+		if err := rows.Scan(&h.messageId, &h.threadKey, &h.ctime, &h.message, &h.sender, &h.permalink); err != nil {
+			return nil, err
+		}
+		hits = append(hits, h)
+	}
+
+	return hits, rows.Err()
+}
+
+func scanRankedHits(rows *sql.Rows) ([]*searchHit, error) {
+	defer rows.Close()
+
+	var hits []*searchHit
+	for rows.Next() {
+		h := &searchHit{ranked: true}
+		if err := rows.Scan(&h.messageId, &h.threadKey, &h.ctime, &h.message, &h.sender, &h.permalink,
+			&h.tagMatches, &h.keywordMatches, &h.ageDays, &h.reactions); err != nil {
+			return nil, err
+		}
+		hits = append(hits, h)
+	}
+
+	return hits, rows.Err()
+}
+
+// Conditions on the messages matching a query with the terms in $3, the sender in $5, the kinds of artifacts in $6 and
+// the tickets in $7. Filters only queries match all messages with the artifacts, messages also match the tags of their thread.
+const (
+	matchOR  = "(cardinality($3::text[])=0 OR $3 && (tags || keywords || entities || COALESCE(thread_tags, '{}'))) AND ($5='' OR user_id=$5) AND $6 <@ COALESCE(has, '{}') AND (cardinality($7::text[])=0 OR $7 && tickets) AND deleted_at IS NULL"
+	matchAND = "$3 <@ (tags || keywords || entities || COALESCE(thread_tags, '{}')) AND ($5='' OR user_id=$5) AND $6 <@ COALESCE(has, '{}') AND (cardinality($7::text[])=0 OR $7 && tickets) AND deleted_at IS NULL"
+)
+
+func matchCondition(q *utils.Query) string {
+	if q.Op == '+' {
+		return matchAND
+	}
+
+	return matchOR
+}
+
+// SearchRanking is the default ranking of search results, set at startup
+var SearchRanking = utils.DefaultRanking
+
+// scoredMessages scores the messages matching the conditions as utils.Ranking.Score with the weights in $8 to $11.
+// The decay exponent is capped so that very old messages score near 0 rather than underflowing.
+// Query terms are matched against the tags of the message and its thread first, then against its keywords and entities.
+const scoredMessages = `SELECT *, (1 + $8::float8 * tag_matches + $9::float8 * keyword_matches) * (CASE WHEN $10::float8 > 0 THEN power(0.5, LEAST(age_days / $10::float8, 1000)) ELSE 1 END) + $11::float8 * ln(1 + reaction_count) AS score FROM (
+		SELECT *,
+			cardinality(ARRAY(SELECT unnest($3::text[]) INTERSECT SELECT unnest(COALESCE(tags, '{}') || COALESCE(thread_tags, '{}')))) AS tag_matches,
+			cardinality(ARRAY(SELECT unnest($3::text[]) INTERSECT SELECT unnest(COALESCE(keywords, '{}') || COALESCE(entities, '{}')) EXCEPT SELECT unnest(COALESCE(tags, '{}') || COALESCE(thread_tags, '{}')))) AS keyword_matches,
+			GREATEST(EXTRACT(EPOCH FROM NOW() - ctime)::float8 / 86400, 0) AS age_days,
+			GREATEST(COALESCE(reactions, 0), 0) AS reaction_count
+		FROM indexer WHERE %s) AS matched`
+
+// rankedQuery returns the best ranked hits with the parts of their score
+const rankedQuery = "SELECT " + hitColumns + ", tag_matches, keyword_matches, age_days, reaction_count FROM (" + scoredMessages + ") AS scored ORDER BY score DESC, ctime DESC LIMIT $4"
+
+// searchThread is a search result, a message outside of threads has no parent nor replies
+type searchThread struct {
+	key     string
+	parent  *searchHit
+	replies []*searchHit
+	matched []*searchHit
+}
+
+// expandThreads groups the hits by thread in order of the best ranked match, with the parent and top replies of each thread
+func expandThreads(db types.DBH, userbaseId, roomId string, hits []*searchHit) ([]*searchThread, error) {
+	var threads []*searchThread
+	var keyed = make(map[string]*searchThread)
+	var keys []string
+	for _, h := range hits {
+		if len(h.threadKey) == 0 {
+			threads = append(threads, &searchThread{parent: h})
+			continue
+		}
+
+		t, ok := keyed[h.threadKey]
+		if !ok {
+			t = &searchThread{key: h.threadKey}
+			keyed[h.threadKey] = t
+			keys = append(keys, h.threadKey)
+			threads = append(threads, t)
+		}
+		t.matched = append(t.matched, h)
+	}
+
+	if len(keys) == 0 {
+		return threads, nil
+	}
+
+	rows, err := db.Query("SELECT "+hitColumns+" FROM (SELECT *, row_number() OVER (PARTITION BY COALESCE(NULLIF(thread_id, ''), message_id) ORDER BY ctime) AS n FROM indexer WHERE userbase_id=$1 AND room_id=$2 AND (message_id = ANY($3) OR thread_id = ANY($3)) AND deleted_at IS NULL) AS thread WHERE n <= $4 ORDER BY ctime",
+		userbaseId, roomId, pq.Array(keys), threadScan)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := scanHits(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var others = make(map[string][]*searchHit)
+	for _, m := range msgs {
+		t, ok := keyed[m.threadKey]
+		if !ok {
+			continue
+		}
+
+		if m.messageId == t.key {
+			t.parent = m
+		} else {
+			others[t.key] = append(others[t.key], m)
+		}
+	}
+
+	for _, t := range threads {
+		if len(t.key) > 0 {
+			t.pickReplies(others[t.key])
+		}
+	}
+
+	return threads, nil
+}
+
+// pickReplies keeps the matching replies, then the earliest ones, in the order they were sent
+func (t *searchThread) pickReplies(replies []*searchHit) {
+	var matched = make(map[string]bool)
+	for _, h := range t.matched {
+		if h.messageId != t.key {
+			matched[h.messageId] = true
+		}
+	}
+
+	// Matches beyond the scanned messages of long threads
+	var scanned = make(map[string]bool)
+	for _, r := range replies {
+		scanned[r.messageId] = true
+	}
+	for _, h := range t.matched {
+		if matched[h.messageId] && !scanned[h.messageId] {
+			replies = append(replies, h)
+		}
+	}
+	sort.SliceStable(replies, func(i, j int) bool {
+		return replies[i].ctime.Before(replies[j].ctime)
+	})
+
+	var picked = make(map[*searchHit]bool)
+	for _, pass := range []bool{true, false} {
+		for _, r := range replies {
+			if len(picked) < threadReplies && matched[r.messageId] == pass {
+				picked[r] = true
+			}
+		}
+	}
+
+	for _, r := range replies {
+		if picked[r] {
+			t.replies = append(t.replies, r)
+		}
+	}
+
+	// A matched parent may not be indexed, or the hits may be all there is
+	if t.parent == nil && len(t.replies) == 0 {
+		t.replies = t.matched
+	}
+}
+
+// Output formats of search results
+const (
+	formatText     = "text"
+	formatMarkdown = "markdown"
+)
+
+// Default length of result snippets in characters
+const snippetLength = 160
+
+// resultFormat controls the rendering of search results
+type resultFormat struct {
+	format string
+
+	// Snippet length, whole messages if 0
+	length int
+
+	// Name of the room searched
+	room string
+
+	// Explain the score of ranked hits
+	debug   bool
+	ranking utils.Ranking
+
+	// Normalized query terms to highlight
+	terms []string
+
+	now time.Time
+}
+
+func (f *resultFormat) mark(w string) string {
+	if f.format == formatMarkdown {
+		return "**" + w + "**"
+	}
+
+	return "*" + w + "*"
+}
+
+func (t *searchThread) write(buff *bytes.Buffer, f *resultFormat) {
+	if t.parent != nil {
+		t.parent.write(buff, "", f)
+	}
+	for _, r := range t.replies {
+		r.write(buff, "    ", f)
+	}
+}
+
+func (h *searchHit) write(buff *bytes.Buffer, indent string, f *resultFormat) {
+	when := utils.RelativeTime(h.ctime, f.now)
+	snippet := utils.Snippet(h.message, f.terms, f.length, f.mark)
+
+	if f.format == formatMarkdown {
+		buff.WriteString(fmt.Sprintf("\n%s_%s_ **%s** in _%s_\n%s%s\n", indent, when, h.sender, f.room, indent, snippet))
+	} else {
+		buff.WriteString(fmt.Sprintf("\n%s%s %s in %s >\n%s%s\n", indent, when, h.sender, f.room, indent, snippet))
+	}
+	if len(h.permalink) > 0 {
+		buff.WriteString(indent + h.permalink + "\n")
+	}
+	if f.debug && h.ranked {
+		buff.WriteString(indent + f.ranking.Explain(h.tagMatches, h.keywordMatches, h.ageDays, h.reactions) + "\n")
+	}
+}
+
 // NewSearchPlugin creates an instance of search plugin implementing Psyche interface
 func NewSearchPlugin(db *sql.DB, p Psyches) Psyche {
 	return &searchPlugin{types.DBH{db}, p}
@@ -28,7 +293,7 @@ func NewSearchPlugin(db *sql.DB, p Psyches) Psyche {
 
 func (p *searchPlugin) Handle(url *url.URL, rmsg *types.RecvMsg) (*types.SendMsg, error) {
 	// Context: userbaseID:chatroomID
-	scope := strings.Split(rmsg.Context, ":")
+	scope := strings.SplitN(rmsg.Context, ":", 2)
 	if len(scope) != 2 {
 		return nil, types.ErrSearch{fmt.Errorf("missing userbase:chatroom for scope")}
 	}
@@ -49,6 +314,60 @@ func (p *searchPlugin) Handle(url *url.URL, rmsg *types.RecvMsg) (*types.SendMsg
 		target = scope[0] + ":" + rmsg.Sender.ID
 	}
 
+	var userId string
+	switch url.Query().Get("scope") {
+	case "self", "me", "mine", "myself":
+		userId = rmsg.Sender.ID
+	}
+
+	// Results in markdown or text, with snippets of the given length
+	f := &resultFormat{format: formatText, length: snippetLength}
+	if url.Query().Get("format") == formatMarkdown {
+		f.format = formatMarkdown
+	}
+	if v, err := strconv.Atoi(url.Query().Get("snippet")); err == nil && v >= 0 {
+		f.length = v
+	}
+	f.debug, _ = strconv.ParseBool(url.Query().Get("debug"))
+
+	// Weights of the ranking can be tuned per query
+	ranking, err := utils.ParseRanking(url.Query().Get("ranking"), SearchRanking)
+	if err != nil {
+		return nil, types.ErrSearch{err}
+	}
+
+	// The matches as a document rather than results
+	if format := url.Query().Get("export"); len(format) > 0 {
+		if !IsExportFormat(format) {
+			return nil, types.ErrSearch{fmt.Errorf("unknown export format %s", format)}
+		}
+
+		r := SearchRequest{Context: rmsg.Context, Text: rmsg.Message, Sender: userId, Limit: maxSearchLimit, Ranking: ranking}
+		smsg, err := p.export(r, format)
+		if err != nil || smsg == nil {
+			return nil, err
+		}
+		return nil, relay.RelayMsg(rmsg, target, smsg)
+	}
+
+	var reply string
+	if facets, _ := strconv.ParseBool(url.Query().Get("facets")); facets {
+		// Summaries of the matches, across the rooms of the userbase the sender took part in with rooms=all
+		reply, err = p.facets(scope[0], scope[1], rmsg.Sender.ID, userId, rmsg.Message, url.Query().Get("rooms") == "all", f)
+	} else {
+		reply, err = p.search(scope[0], scope[1], userId, rmsg.Message, ranking, f)
+	}
+	if err != nil || len(reply) == 0 {
+		return nil, err
+	}
+
+	smsg := types.SendMsg{reply, f.format}
+	return nil, relay.RelayMsg(rmsg, target, &smsg)
+}
+
+// search runs the query in the room, limited to the messages of userId if given, and renders the results in order of ranking.
+// The reply is empty without results.
+func (p *searchPlugin) search(userbaseId, roomId, userId, text string, ranking utils.Ranking, f *resultFormat) (string, error) {
 	// TODO:
 	// * Well defined search syntax
 	// * Date range based search
@@ -56,73 +375,87 @@ func (p *searchPlugin) Handle(url *url.URL, rmsg *types.RecvMsg) (*types.SendMsg
 	// * Suggest tags to limit search
 	// * Background search jobs for more heuristics in the future
 
-	queryOp, tags := utils.ExtractQueryTags(rmsg.Message)
-	if len(tags) == 0 {
-		return nil, nil
+	q, err := loadQuery(p.db, userbaseId, roomId, text)
+	if err != nil || q.Empty() {
+		return "", err
 	}
+	tags := q.Tags
 
-	const queryORSelf = "SELECT ctime, message FROM indexer WHERE userbase_id=$1 AND room_id=$2 AND $3 && (tags || keywords) AND user_id=$5 ORDER BY ctime DESC LIMIT $4"
-	const queryANDSelf = "SELECT ctime, message FROM indexer WHERE userbase_id=$1 AND room_id=$2 AND $3 <@ (tags || keywords) AND user_id=$5 ORDER BY ctime DESC LIMIT $4"
+	query := fmt.Sprintf(rankedQuery, "userbase_id=$1 AND room_id=$2 AND "+matchCondition(q))
 
-	const queryORRoom = "SELECT ctime, message FROM indexer WHERE userbase_id=$1 AND room_id=$2 AND $3 && (tags || keywords) ORDER BY ctime DESC LIMIT $4"
-	const queryANDRoom = "SELECT ctime, message FROM indexer WHERE userbase_id=$1 AND room_id=$2 AND $3 <@ (tags || keywords) ORDER BY ctime DESC LIMIT $4"
+	// Empty rather than NULL arrays for the absent parts of the query
+	rows, err := p.db.Query(query, userbaseId, roomId, pq.Array(append([]string{}, tags...)), resultLimit+1, userId,
+		pq.Array(append([]string{}, q.Has...)), pq.Array(append([]string{}, q.Tickets...)),
+		ranking.Tag, ranking.Keyword, ranking.HalfLife, ranking.Reactions)
 
-	var err error
-	var rows *sql.Rows
-	switch url.Query().Get("scope") {
-	case "self", "me", "mine", "myself":
-		if queryOp == '+' {
-			rows, err = p.db.Query(queryANDSelf, scope[0], scope[1], pq.Array(tags), resultLimit+1, rmsg.Sender.ID)
-		} else {
-			rows, err = p.db.Query(queryORSelf, scope[0], scope[1], pq.Array(tags), resultLimit+1, rmsg.Sender.ID)
-		}
-	case "room", "chatroom", "conversation":
-		fallthrough
-	default:
-		if queryOp == '+' {
-			rows, err = p.db.Query(queryANDRoom, scope[0], scope[1], pq.Array(tags), resultLimit+1)
-		} else {
-			rows, err = p.db.Query(queryORRoom, scope[0], scope[1], pq.Array(tags), resultLimit+1)
-		}
+	// Query failure, nothing much to do!
+	if err != nil {
+		return "", err
 	}
 
-	// Query failure, nothing much to do!
+	hits, err := scanRankedHits(rows)
+	if err != nil || len(hits) == 0 {
+		return "", err
+	}
+
+	// NOTE: We fetch 1 more than the limit to determine if there are more results than the limit
+	truncated := len(hits) > resultLimit
+	if truncated {
+		hits = hits[:resultLimit]
+	}
+
+	threads, err := expandThreads(p.db, userbaseId, roomId, hits)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	var resultCount int
-	var msg, ct string
-	var buff bytes.Buffer
-	for rows.Next() {
-		err = rows.Scan(&ct, &msg)
-		if err != nil {
-			break
+	f.room, f.terms, f.now, f.ranking = roomId, tags, time.Now(), ranking
+	if relay, ok := p.plugins["relay"].(*relayPlugin); ok {
+		if name := relay.RoomName(userbaseId + ":" + roomId); len(name) > 0 {
+			f.room = name
 		}
+	}
 
-		resultCount++
+	var buff bytes.Buffer
+	for _, t := range threads {
+		t.write(&buff, f)
+	}
 
-		// NOTE: We fetch 1 more than the limit to determine if there are more results than the limit
-		if resultCount < resultLimit {
-			buff.WriteString(fmt.Sprintf("\n%s >\n%s\n", ct, msg))
-		}
+	// Provide hints if results are truncated due to search limit
+	var resultHeader string
+	if truncated {
+		resultHeader = fmt.Sprintf("showing %d results, try refining search:\n", len(threads))
+	} else {
+		resultHeader = fmt.Sprintf("showing %d results:\n", len(threads))
 	}
 
-	if resultCount > 0 {
-		var resultHeader string
+	return resultHeader + buff.String(), nil
+}
 
-		// Provide hints if results are truncated due to search limit
-		if resultCount > resultLimit {
-			resultHeader = fmt.Sprintf("showing %d results, try refining search:\n", resultLimit)
-		} else {
-			resultHeader = fmt.Sprintf("showing %d results:\n", resultCount)
-		}
+// loadQuery parses a search query with the vocabulary of the room and resolves its aliases
+func loadQuery(db types.DBH, userbaseId, roomId, text string) (*utils.Query, error) {
+	vocabulary, err := loadVocabulary(db, userbaseId, roomId)
+	if err != nil {
+		return nil, types.ErrSearch{fmt.Errorf("failed to load vocabulary with error %s", err)}
+	}
+
+	aliases, err := loadAliases(db, userbaseId, roomId)
+	if err != nil {
+		return nil, types.ErrSearch{fmt.Errorf("failed to load aliases with error %s", err)}
+	}
+
+	return parseQuery(text, vocabulary, aliases), nil
+}
+
+func parseQuery(text string, vocabulary *utils.Vocabulary, aliases utils.Aliases) *utils.Query {
+	q := utils.ParseQuery(text, vocabulary)
 
-		smsg := types.SendMsg{resultHeader + buff.String(), "text"}
-		err = relay.RelayMsg(rmsg, target, &smsg)
+	// Search aliases by their canonical term
+	for i, t := range q.Tags {
+		q.Tags[i] = aliases.Resolve(t)
 	}
 
-	return nil, err
+	return q
 }
 
 func (p *searchPlugin) Refresh() error {
@@ -0,0 +1,140 @@
+package plugins
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"bitbucket.org/psyche/types"
+	"bitbucket.org/psyche/utils"
+	"github.com/lib/pq"
+)
+
+// Most hits returned by a structured search
+const maxSearchLimit = 500
+
+// SearchRequest is a structured search in a room. The free text is parsed as a search in chat, the other fields add to it.
+type SearchRequest struct {
+	// userbase:room
+	Context string
+	Text    string
+
+	// Terms normalized as hash tags, all of them must match with All
+	Tags []string
+	All  bool
+
+	// Kinds of artifacts the messages must have and ticket keys they must refer to any of
+	Has     []string
+	Tickets []string
+
+	// Sender ID the messages are limited to
+	Sender string
+
+	// Number of hits, resultLimit if 0
+	Limit int
+
+	Ranking utils.Ranking
+}
+
+// SearchHit is a message matching a structured search
+type SearchHit struct {
+	ID         string    `json:"id"`
+	Room       string    `json:"room"`
+	ThreadID   string    `json:"thread_id,omitempty"`
+	Sender     string    `json:"sender"`
+	SenderName string    `json:"sender_name,omitempty"`
+	Time       time.Time `json:"time"`
+	Tags       []string  `json:"tags"`
+	Keywords   []string  `json:"keywords"`
+	Message    string    `json:"message"`
+	Permalink  string    `json:"permalink,omitempty"`
+	Score      float64   `json:"score"`
+}
+
+// SearchResults are the hits of a structured search in order of ranking
+type SearchResults struct {
+	Hits []SearchHit `json:"hits"`
+
+	// More messages matched than the limit
+	Truncated bool `json:"truncated"`
+}
+
+// text renders the structured parts of the request in the query syntax, so that they are normalized as typed in chat
+func (r *SearchRequest) text() string {
+	words := []string{r.Text}
+	for _, t := range r.Tags {
+		words = append(words, "#"+strings.TrimPrefix(t, "#"))
+	}
+	for _, h := range r.Has {
+		words = append(words, "has:"+h)
+	}
+	for _, t := range r.Tickets {
+		words = append(words, "ticket:"+t)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// Search runs a structured search with the search plugin, hits are messages rather than threads
+func Search(search Psyche, r SearchRequest) (*SearchResults, error) {
+	p, ok := search.(*searchPlugin)
+	if !ok {
+		return nil, types.ErrSearch{fmt.Errorf("structured search requires the search plugin")}
+	}
+
+	scope := strings.SplitN(r.Context, ":", 2)
+	if len(scope) != 2 || len(scope[0]) == 0 || len(scope[1]) == 0 {
+		return nil, types.ErrSearch{fmt.Errorf("missing userbase:chatroom for scope")}
+	}
+
+	limit := r.Limit
+	if limit <= 0 {
+		limit = resultLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	q, err := loadQuery(p.db, scope[0], scope[1], r.text())
+	if err != nil {
+		return nil, err
+	}
+	if r.All {
+		q.Op = '+'
+	}
+
+	results := &SearchResults{Hits: []SearchHit{}}
+	if q.Empty() {
+		return results, nil
+	}
+
+	query := "SELECT COALESCE(message_id, ''), room_id, COALESCE(thread_id, ''), user_id, COALESCE(sender_name, ''), ctime, message, COALESCE(tags, '{}'), COALESCE(keywords, '{}'), COALESCE(permalink, ''), score FROM (" +
+		fmt.Sprintf(scoredMessages, "userbase_id=$1 AND room_id=$2 AND "+matchCondition(q)) + ") AS scored ORDER BY score DESC, ctime DESC LIMIT $4"
+
+	rows, err := p.db.Query(query, scope[0], scope[1], pq.Array(append([]string{}, q.Tags...)), limit+1, r.Sender,
+		pq.Array(append([]string{}, q.Has...)), pq.Array(append([]string{}, q.Tickets...)),
+		r.Ranking.Tag, r.Ranking.Keyword, r.Ranking.HalfLife, r.Ranking.Reactions)
+	if err != nil {
+		return nil, types.ErrSearch{err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h SearchHit
+		if err = rows.Scan(&h.ID, &h.Room, &h.ThreadID, &h.Sender, &h.SenderName, &h.Time, &h.Message,
+			pq.Array(&h.Tags), pq.Array(&h.Keywords), &h.Permalink, &h.Score); err != nil {
+			return nil, types.ErrSearch{err}
+		}
+		results.Hits = append(results.Hits, h)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, types.ErrSearch{err}
+	}
+
+	// NOTE: We fetch 1 more than the limit to determine if there are more results than the limit
+	if len(results.Hits) > limit {
+		results.Hits, results.Truncated = results.Hits[:limit], true
+	}
+
+	return results, nil
+}
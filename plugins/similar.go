@@ -0,0 +1,230 @@
+package plugins
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"bitbucket.org/psyche/types"
+	"bitbucket.org/psyche/utils"
+	"github.com/lib/pq"
+)
+
+type similarPlugin struct {
+	db      types.DBH
+	plugins Psyches
+
+	// pg_trgm is available for trigram similarity of the text
+	trigram bool
+}
+
+// Similar messages shown and the least score of a similar message
+const (
+	similarLimit    = 5
+	similarMinScore = 0.2
+)
+
+// Weights of the overlap of rare terms and of the trigram similarity of the text in the score of a similar message
+const (
+	overlapWeight = 0.7
+	trigramWeight = 0.3
+)
+
+// NewSimilarPlugin creates an instance of similar message plugin implementing Psyche interface
+func NewSimilarPlugin(db *sql.DB, p Psyches) Psyche {
+	r := &similarPlugin{db: types.DBH{db}, plugins: p}
+
+	// Without pg_trgm, messages are similar by their terms only
+	_, err := r.db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm")
+	if err == nil {
+		_, err = r.db.Exec("CREATE INDEX IF NOT EXISTS indexer_message_trgm ON indexer USING gin (message gin_trgm_ops)")
+	}
+	if err != nil {
+		log.Printf("trigram similarity disabled with error %s", err)
+	}
+	r.trigram = err == nil
+
+	return r
+}
+
+// similarSource is the message similar messages are found for
+type similarSource struct {
+	messageId string
+	text      string
+	terms     []string
+
+	// Only messages sent before, any time if zero
+	before time.Time
+}
+
+// similarHit is a similar message with its score between 0 and 1
+type similarHit struct {
+	*searchHit
+	score float64
+}
+
+// Handle finds the messages of the room most similar to an indexed message, given by ID or permalink, or to the text of the message
+func (p *similarPlugin) Handle(u *url.URL, rmsg *types.RecvMsg) (*types.SendMsg, error) {
+	// Context: userbaseID:chatroomID
+	scope := strings.SplitN(rmsg.Context, ":", 2)
+	if len(scope) != 2 {
+		return nil, types.ErrSimilar{fmt.Errorf("missing userbase:chatroom for scope")}
+	}
+
+	val, ok := p.plugins["relay"]
+	if !ok {
+		return nil, types.ErrSimilar{errors.New("failed to get relay plugin")}
+	}
+
+	relay, ok := val.(*relayPlugin)
+	if !ok {
+		return nil, types.ErrSimilar{errors.New("failed to cast relay plugin interface")}
+	}
+
+	target := u.Query().Get("target")
+	if len(target) == 0 {
+		// Look for user registered room for sending messages (UserbaseId:AAID)
+		target = scope[0] + ":" + rmsg.Sender.ID
+	}
+
+	input := strings.TrimSpace(rmsg.Message)
+	if len(input) == 0 {
+		return nil, types.ErrSimilar{errors.New("missing message ID or text to find similar messages to")}
+	}
+
+	src, err := p.source(scope[0], scope[1], input)
+	if err != nil {
+		return nil, err
+	}
+
+	hits, err := p.find(scope[0], scope[1], src, similarLimit, similarMinScore)
+	if err != nil {
+		return nil, err
+	}
+	if len(hits) == 0 {
+		return nil, relay.RelayMsg(rmsg, target, types.NewSendMsg("no similar messages found"))
+	}
+
+	f := &resultFormat{format: formatText, length: snippetLength, room: scope[1], terms: src.terms, now: time.Now()}
+	if u.Query().Get("format") == formatMarkdown {
+		f.format = formatMarkdown
+	}
+	if name := relay.RoomName(rmsg.Context); len(name) > 0 {
+		f.room = name
+	}
+
+	var buff bytes.Buffer
+	buff.WriteString(fmt.Sprintf("showing %d similar messages:\n", len(hits)))
+	for _, h := range hits {
+		h.write(&buff, "", f)
+		buff.WriteString(fmt.Sprintf("%.0f%% similar\n", 100*h.score))
+	}
+
+	return nil, relay.RelayMsg(rmsg, target, &types.SendMsg{buff.String(), f.format})
+}
+
+// source resolves the input to an indexed message by ID or permalink, or else extracts the terms of the text
+func (p *similarPlugin) source(userbaseId, roomId, input string) (*similarSource, error) {
+	src := &similarSource{text: input}
+
+	if len(strings.Fields(input)) == 1 {
+		var tags, keywords, entities []string
+		err := p.db.QueryRow("SELECT COALESCE(message_id, ''), message, COALESCE(tags, '{}'), COALESCE(keywords, '{}'), COALESCE(entities, '{}') FROM indexer WHERE userbase_id=$1 AND room_id=$2 AND (message_id=$3 OR permalink=$3) AND deleted_at IS NULL LIMIT 1",
+			userbaseId, roomId, input).Scan(&src.messageId, &src.text, pq.Array(&tags), pq.Array(&keywords), pq.Array(&entities))
+		if err == nil {
+			src.terms = append(append(tags, keywords...), entities...)
+			return src, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, types.ErrSimilar{err}
+		}
+	}
+
+	d, err := similarTerms(p.db, userbaseId, roomId, input)
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		src.terms = append(append(d.Tags, d.Keywords...), d.Entities...)
+	}
+
+	return src, nil
+}
+
+// similarTerms extracts the terms of a text as it would be indexed in the room, untagged text included
+func similarTerms(db types.DBH, userbaseId, roomId, text string) (*utils.IndexData, error) {
+	settings, err := loadRoomSettings(db, userbaseId, roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := settings.options(true)
+	opts.MinWords = 0
+
+	d := utils.Index(text, opts)
+	if d.OptedOut {
+		return nil, nil
+	}
+
+	return d, nil
+}
+
+// find returns the messages most similar to the source, at least minScore similar.
+// The score weighs the share of the rarity weighted terms of the source found in a message and the trigram similarity of their text.
+func (p *similarPlugin) find(userbaseId, roomId string, src *similarSource, limit int, minScore float64) ([]*similarHit, error) {
+	if len(src.terms) == 0 && !p.trigram {
+		return nil, nil
+	}
+
+	var terms []string
+	var weights []float64
+	var total float64
+	for t, w := range utils.RarityWeights(src.terms, newRoomCorpus(p.db, userbaseId, roomId)) {
+		terms, weights = append(terms, t), append(weights, w)
+		total += w
+	}
+	if total == 0 {
+		total = 1
+	}
+
+	before := pq.NullTime{Time: src.before, Valid: !src.before.IsZero()}
+	trigram, candidate := "0::float8", ""
+	args := []interface{}{userbaseId, roomId, pq.Array(append([]string{}, terms...)), pq.Array(append([]float64{}, weights...)), total, src.messageId, limit, minScore}
+	if p.trigram {
+		trigram, candidate = "similarity(message, $12)", " OR message % $12"
+		args = append(args, overlapWeight, trigramWeight, before, src.text)
+	} else {
+		args = append(args, 1.0, 0.0, before)
+	}
+
+	query := "SELECT " + hitColumns + ", $9::float8 * overlap + $10::float8 * trgm AS score FROM (" +
+		"SELECT *, COALESCE((SELECT sum(w) FROM unnest($3::text[], $4::float8[]) AS t(term, w) WHERE term = ANY(COALESCE(tags, '{}') || COALESCE(keywords, '{}') || COALESCE(entities, '{}'))), 0) / $5::float8 AS overlap, " + trigram + " AS trgm " +
+		"FROM indexer WHERE userbase_id=$1 AND room_id=$2 AND ($6='' OR COALESCE(message_id, '') <> $6) AND ($11::timestamp IS NULL OR ctime < $11) AND deleted_at IS NULL AND ((COALESCE(tags, '{}') || COALESCE(keywords, '{}') || COALESCE(entities, '{}')) && $3" + candidate + ")" +
+		") AS candidates WHERE $9::float8 * overlap + $10::float8 * trgm >= $8 ORDER BY score DESC, ctime DESC LIMIT $7"
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, types.ErrSimilar{err}
+	}
+	defer rows.Close()
+
+	var hits []*similarHit
+	for rows.Next() {
+		h := &similarHit{searchHit: &searchHit{}}
+		if err = rows.Scan(&h.messageId, &h.threadKey, &h.ctime, &h.message, &h.sender, &h.permalink, &h.score); err != nil {
+			return nil, types.ErrSimilar{err}
+		}
+		hits = append(hits, h)
+	}
+
+	return hits, rows.Err()
+}
+
+func (p *similarPlugin) Refresh() error {
+	return nil
+}
@@ -0,0 +1,112 @@
+// Package signature signs and verifies messages posted by psyche to registered rooms.
+//
+// Every POST carries the headers below. Rooms are given a generated secret on registration,
+// which admins get from the /secret endpoint. The signature is computed as
+//
+//	v1=hex(HMAC-SHA256(secret, timestamp + "." + body))
+//
+// Receivers should reject requests with a stale timestamp and use the delivery ID
+// to drop retried deliveries they have already processed.
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// HeaderSignature carries the versioned HMAC of the request
+	HeaderSignature = "X-Psyche-Signature"
+	// HeaderTimestamp carries the signing time in seconds since epoch
+	HeaderTimestamp = "X-Psyche-Timestamp"
+	// HeaderDelivery carries a unique ID per delivery for idempotency
+	HeaderDelivery = "X-Psyche-Delivery"
+)
+
+// Version prefix of the signature scheme
+const version = "v1="
+
+// DefaultTolerance is the accepted clock skew between psyche and the receiver
+const DefaultTolerance = 5 * time.Minute
+
+var (
+	ErrMissingHeaders = errors.New("signature: missing signature or timestamp header")
+	ErrStale          = errors.New("signature: timestamp outside tolerance")
+	ErrMismatch       = errors.New("signature: signature mismatch")
+)
+
+// Sign returns the signature of body at timestamp using secret
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return version + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewDeliveryID returns a random ID identifying a delivery
+func NewDeliveryID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// NewSecret returns a random secret for signing the messages posted to a room
+func NewSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// SignRequest sets delivery, timestamp and signature headers on req
+func SignRequest(req *http.Request, secret string, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set(HeaderDelivery, NewDeliveryID())
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderSignature, Sign(secret, ts, body))
+}
+
+// Verify checks the signature of req with secret and returns the request body
+func Verify(req *http.Request, secret string, tolerance time.Duration) ([]byte, error) {
+	sig := req.Header.Get(HeaderSignature)
+	ts := req.Header.Get(HeaderTimestamp)
+	if len(sig) == 0 || len(ts) == 0 {
+		return nil, ErrMissingHeaders
+	}
+
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, ErrMissingHeaders
+	}
+
+	skew := time.Since(time.Unix(secs, 0))
+	if skew > tolerance || skew < -tolerance {
+		return nil, ErrStale
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Restore the body for handlers decoding the request after verification
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if !hmac.Equal([]byte(sig), []byte(Sign(secret, ts, body))) {
+		return nil, ErrMismatch
+	}
+
+	return body, nil
+}
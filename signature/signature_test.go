@@ -0,0 +1,63 @@
+package signature
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"text":"hello","format":"text"}`)
+
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	SignRequest(req, "s3cret", body)
+	require.NotEmpty(t, req.Header.Get(HeaderDelivery))
+
+	got, err := Verify(req, "s3cret", DefaultTolerance)
+	require.NoError(t, err)
+	require.Equal(t, body, got)
+
+	req = httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	SignRequest(req, "s3cret", body)
+	_, err = Verify(req, "other", DefaultTolerance)
+	require.Equal(t, ErrMismatch, err)
+
+	// Tampered body
+	req = httptest.NewRequest("POST", "/", bytes.NewReader(append(body, ' ')))
+	SignRequest(req, "s3cret", body)
+	_, err = Verify(req, "s3cret", DefaultTolerance)
+	require.Equal(t, ErrMismatch, err)
+}
+
+func TestVerifyStale(t *testing.T) {
+	body := []byte("{}")
+	ts := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderSignature, Sign("s3cret", ts, body))
+
+	_, err := Verify(req, "s3cret", DefaultTolerance)
+	require.Equal(t, ErrStale, err)
+
+	// Unsigned deliveries
+	req = httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(time.Now().Unix(), 10))
+	_, err = Verify(req, "s3cret", DefaultTolerance)
+	require.Equal(t, ErrMissingHeaders, err)
+}
+
+func TestNewSecret(t *testing.T) {
+	require.Len(t, NewSecret(), 64)
+	require.NotEqual(t, NewSecret(), NewSecret())
+
+	// Requests are signed with any secret
+	req := httptest.NewRequest("POST", "/", nil)
+	SignRequest(req, NewSecret(), nil)
+	require.NotEmpty(t, req.Header.Get(http.CanonicalHeaderKey(HeaderSignature)))
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"io"
+	"time"
 )
 
 // SendMsg models the message sent to botler via POST
@@ -16,13 +17,57 @@ func NewSendMsg(msg string) *SendMsg {
 	return &SendMsg{msg, "text"}
 }
 
-// RecvMsg models the message received from botler
+// Events notified for a message, a new message has no event
+const (
+	EventMessage    = ""
+	EventEdit       = "edit"
+	EventDelete     = "delete"
+	EventReaction   = "reaction"
+	EventUnreaction = "unreaction"
+)
+
+// RecvMsg models the message received from botler.
+// Edit, delete and reaction events carry the ID of the original message.
 type RecvMsg struct {
-	Message string `json:"message"`
-	Context string `json:"context"`
-	Sender  struct {
-		ID string `json:"id"`
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	Message   string    `json:"message"`
+	Context   string    `json:"context"`
+	Timestamp time.Time `json:"timestamp"`
+	ThreadID  string    `json:"thread_id"`
+	Permalink string    `json:"permalink"`
+	Sender    struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		Bot  bool   `json:"bot"`
 	} `json:"sender"`
+	Mentions    []string     `json:"mentions"`
+	Attachments []Attachment `json:"attachments"`
+}
+
+// Attachment models a file or link shared along with the message
+type Attachment struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// SenderName returns the display name of the sender if known, the sender ID otherwise
+func (r *RecvMsg) SenderName() string {
+	if len(r.Sender.Name) > 0 {
+		return r.Sender.Name
+	}
+
+	return r.Sender.ID
+}
+
+// AttachmentURLs returns the URLs of all attachments in the message
+func (r *RecvMsg) AttachmentURLs() []string {
+	var urls []string
+	for _, a := range r.Attachments {
+		urls = append(urls, a.URL)
+	}
+
+	return urls
 }
 
 // NewRecvMsg constructs a RecvMsg from HTTP POST request
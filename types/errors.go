@@ -35,3 +35,122 @@ type ErrIndexer struct {
 func (e ErrIndexer) Error() string {
 	return e.Err.Error()
 }
+
+// ErrInbound captures inbound payload decoding errors
+type ErrInbound struct {
+	Err error
+}
+
+func (e ErrInbound) Error() string {
+	return e.Err.Error()
+}
+
+// ErrStatus captures non-2xx responses to outbound requests
+type ErrStatus struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e ErrStatus) Error() string {
+	return "http post to " + e.URL + " returned error " + e.Status
+}
+
+// ErrCircuitOpen captures outbound requests rejected while the target host is failing
+type ErrCircuitOpen struct {
+	Host string
+}
+
+func (e ErrCircuitOpen) Error() string {
+	return "circuit open for " + e.Host
+}
+
+// ErrAlias captures alias plugin errors
+type ErrAlias struct {
+	Err error
+}
+
+func (e ErrAlias) Error() string {
+	return e.Err.Error()
+}
+
+// ErrIgnore captures ignore plugin errors
+type ErrIgnore struct {
+	Err error
+}
+
+func (e ErrIgnore) Error() string {
+	return e.Err.Error()
+}
+
+// ErrExclude captures exclude plugin errors
+type ErrExclude struct {
+	Err error
+}
+
+func (e ErrExclude) Error() string {
+	return e.Err.Error()
+}
+
+// ErrForget captures forget plugin errors
+type ErrForget struct {
+	Err error
+}
+
+func (e ErrForget) Error() string {
+	return e.Err.Error()
+}
+
+// ErrRetention captures retention plugin errors
+type ErrRetention struct {
+	Err error
+}
+
+func (e ErrRetention) Error() string {
+	return e.Err.Error()
+}
+
+// ErrImport captures bulk import errors
+type ErrImport struct {
+	Err error
+}
+
+func (e ErrImport) Error() string {
+	return e.Err.Error()
+}
+
+// ErrReindex captures reindex job errors
+type ErrReindex struct {
+	Err error
+}
+
+func (e ErrReindex) Error() string {
+	return e.Err.Error()
+}
+
+// ErrSaved captures saved search plugin errors
+type ErrSaved struct {
+	Err error
+}
+
+func (e ErrSaved) Error() string {
+	return e.Err.Error()
+}
+
+// ErrSimilar captures similar message plugin errors
+type ErrSimilar struct {
+	Err error
+}
+
+func (e ErrSimilar) Error() string {
+	return e.Err.Error()
+}
+
+// ErrDuplicates captures duplicate question plugin errors
+type ErrDuplicates struct {
+	Err error
+}
+
+func (e ErrDuplicates) Error() string {
+	return e.Err.Error()
+}
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Kinds of artifacts in a message, searchable with has:
+const (
+	HasLink   = "link"
+	HasCode   = "code"
+	HasTrace  = "trace"
+	HasTicket = "ticket"
+)
+
+// Artifacts are the parts of a message which are not prose
+type Artifacts struct {
+	Links []string
+
+	// Host names of the links without www.
+	Domains []string
+
+	// Issue keys like ABC-123
+	Tickets []string
+
+	Code  bool
+	Trace bool
+}
+
+// Has returns the kinds of artifacts found
+func (a *Artifacts) Has() []string {
+	var has []string
+	if len(a.Links) > 0 {
+		has = append(has, HasLink)
+	}
+	if a.Code {
+		has = append(has, HasCode)
+	}
+	if a.Trace {
+		has = append(has, HasTrace)
+	}
+	if len(a.Tickets) > 0 {
+		has = append(has, HasTicket)
+	}
+
+	return has
+}
+
+var (
+	// Fenced code blocks, unterminated blocks run to the end of the message
+	fencedCodeRx = regexp.MustCompile("(?s)```.*?(```|$)")
+	inlineCodeRx = regexp.MustCompile("`[^`\n]+`")
+
+	// Slack wraps links as <https://example.com|label>
+	linkRx = regexp.MustCompile(`<?(https?://[^\s<>|]+)(\|[^>]*)?>?`)
+
+	// Hash tags of ticket keys are kept as tags
+	ticketRx = regexp.MustCompile(`#?\b[A-Z][A-Z0-9]{1,9}-[1-9][0-9]*\b`)
+
+	// Frames of Java, JavaScript, Python and Go stack traces
+	traceFrameRx = regexp.MustCompile(`^\s*(at \S+ ?\(.*\)|at \S+:\d+(:\d+)?|File ".+", line \d+.*|\S+\.go:\d+( \+0x[0-9a-f]+)?)\s*$`)
+
+	// Headers of Python tracebacks and Go panics
+	traceHeaderRx = regexp.MustCompile(`^\s*(Traceback \(most recent call last\):|goroutine \d+ \[.+\]:)\s*$`)
+)
+
+// Standards named like ticket keys: UTF-8, SHA-256
+var notTicketPrefixes = toSet("UTF", "SHA", "ISO", "AES", "RSA", "TLS", "SSL", "HTTP", "RFC")
+
+// Frames needed to tell a stack trace from a message quoting a single location
+const minTraceFrames = 2
+
+// ExtractArtifacts finds links, code, stack traces and ticket keys in a message
+// and returns the message without them, so that they do not count as words.
+func ExtractArtifacts(msg string) (string, *Artifacts) {
+	a := &Artifacts{}
+
+	// Stack traces are often pasted without code fences
+	var lines []string
+	var frames int
+	for _, l := range strings.Split(msg, "\n") {
+		if traceHeaderRx.MatchString(l) {
+			a.Trace = true
+		} else if traceFrameRx.MatchString(l) {
+			frames++
+		} else {
+			lines = append(lines, l)
+		}
+	}
+	if frames >= minTraceFrames {
+		a.Trace = true
+	}
+	if a.Trace {
+		msg = strings.Join(lines, "\n")
+	}
+
+	stripCode := func(string) string {
+		a.Code = true
+		return " "
+	}
+	msg = fencedCodeRx.ReplaceAllStringFunc(msg, stripCode)
+	msg = inlineCodeRx.ReplaceAllStringFunc(msg, stripCode)
+
+	domains := make(map[string]bool)
+	msg = linkRx.ReplaceAllStringFunc(msg, func(m string) string {
+		link := strings.TrimRight(linkRx.FindStringSubmatch(m)[1], ".,;:!?)]}'\"")
+		a.Links = append(a.Links, link)
+
+		if u, err := url.Parse(link); err == nil && len(u.Hostname()) > 0 {
+			domains[strings.TrimPrefix(Fold(u.Hostname()), "www.")] = true
+		}
+		return " "
+	})
+	for d := range domains {
+		a.Domains = append(a.Domains, d)
+	}
+	sort.Strings(a.Domains)
+
+	tickets := make(map[string]bool)
+	msg = ticketRx.ReplaceAllStringFunc(msg, func(m string) string {
+		key := strings.TrimPrefix(m, "#")
+		if notTicketPrefixes[key[:strings.Index(key, "-")]] {
+			return m
+		}
+		if !tickets[key] {
+			tickets[key] = true
+			a.Tickets = append(a.Tickets, key)
+		}
+
+		if strings.HasPrefix(m, "#") {
+			return m
+		}
+		return " "
+	})
+
+	return msg, a
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractArtifacts(t *testing.T) {
+	const msg = "#deploy of PSY-42 failed, see <https://www.GitHub.com/acme/psyche/issues/42|the issue> and https://ci.acme.io/job/7.\n" +
+		"```\nfunc main() { panic(err) }\n```\n" +
+		"run `make deploy` again, output is UTF-8"
+
+	clean, a := ExtractArtifacts(msg)
+	require.Equal(t, []string{"https://www.GitHub.com/acme/psyche/issues/42", "https://ci.acme.io/job/7"}, a.Links)
+	require.Equal(t, []string{"ci.acme.io", "github.com"}, a.Domains)
+	require.Equal(t, []string{"PSY-42"}, a.Tickets)
+	require.True(t, a.Code)
+	require.False(t, a.Trace)
+	require.Equal(t, []string{HasLink, HasCode, HasTicket}, a.Has())
+
+	for _, junk := range []string{"http", "panic", "make", "PSY-42"} {
+		require.NotContains(t, clean, junk)
+	}
+	require.Contains(t, clean, "#deploy")
+	require.Contains(t, clean, "UTF-8")
+
+	// Hash tags of tickets stay tags
+	clean, a = ExtractArtifacts("blocked on #PSY-7")
+	require.Equal(t, []string{"PSY-7"}, a.Tickets)
+	require.Contains(t, clean, "#PSY-7")
+}
+
+func TestExtractTrace(t *testing.T) {
+	const trace = `#crash in the indexer
+java.lang.NullPointerException: null
+	at com.acme.Indexer.index(Indexer.java:42)
+	at com.acme.Server.handle(Server.java:17)`
+
+	clean, a := ExtractArtifacts(trace)
+	require.True(t, a.Trace)
+	require.NotContains(t, clean, "Indexer.java")
+
+	// A single location is not a trace
+	_, a = ExtractArtifacts("the bug is at main.go:12")
+	require.False(t, a.Trace)
+
+	d := Index(trace+"\nsee https://jira.acme.com/browse/PSY-1", IndexOptions{Pct: 0.1})
+	require.Contains(t, d.Tags, "crash")
+	require.Contains(t, d.Tags, "jira.acme.com")
+	require.Contains(t, d.Has, HasTrace)
+	for _, k := range d.Keywords {
+		require.False(t, strings.HasPrefix(k, "http"), k)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	q := ParseQuery("#deploy has:link HAS:code ticket:psy-42 github.com", DefaultVocabulary())
+	require.Equal(t, []string{"deploy", "github.com"}, q.Tags)
+	require.Equal(t, []string{HasLink, HasCode}, q.Has)
+	require.Equal(t, []string{"PSY-42"}, q.Tickets)
+}
+
+func TestQueryMatch(t *testing.T) {
+	d := Index("#deploy failed, see https://ci.acme.io/job/7 for PSY-42", IndexOptions{Pct: 0.1})
+
+	for query, match := range map[string]bool{
+		"deploy":                   true,
+		"deploy rollback":          true,
+		"deploy + rollback":        false,
+		"has:link":                 true,
+		"deploy has:code":          false,
+		"ticket:psy-42 ci.acme.io": true,
+		"ticket:PSY-7":             false,
+		"@search":                  false,
+	} {
+		require.Equal(t, match, ParseQuery(query, DefaultVocabulary()).Match(d), query)
+	}
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"path"
+	"strings"
+)
+
+// Pattern matching all senders flagged as bots by the chat platform
+const BotPattern = "bot"
+
+// Scope levels of exclusion rules, rules of the most specific level matching a sender decide
+const (
+	ScopeGlobal = iota
+	ScopeUserbase
+	ScopeRoom
+)
+
+// ExclusionRule excludes or, as an override, includes senders matching the pattern.
+// Patterns are sender IDs, shell globs like 557058:* or BotPattern.
+type ExclusionRule struct {
+	Pattern string
+	Include bool
+	Scope   int
+}
+
+// Match reports if the rule applies to the sender
+func (r ExclusionRule) Match(senderId string, bot bool) bool {
+	if r.Pattern == BotPattern {
+		return bot
+	}
+
+	if strings.ContainsAny(r.Pattern, "*?[") {
+		ok, _ := path.Match(r.Pattern, senderId)
+		return ok
+	}
+
+	return r.Pattern == senderId
+}
+
+// ExcludeSender returns the rule excluding the sender, nil if the sender is not excluded.
+// An include rule overrides exclude rules of the same or broader scope.
+func ExcludeSender(rules []ExclusionRule, senderId string, bot bool) *ExclusionRule {
+	var decided *ExclusionRule
+	for i := range rules {
+		r := &rules[i]
+		if !r.Match(senderId, bot) {
+			continue
+		}
+
+		if decided == nil || r.Scope > decided.Scope || (r.Scope == decided.Scope && r.Include) {
+			decided = r
+		}
+	}
+
+	if decided == nil || decided.Include {
+		return nil
+	}
+
+	return decided
+}
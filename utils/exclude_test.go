@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExcludeSender(t *testing.T) {
+	rules := []ExclusionRule{
+		{Pattern: "557058:48faede9-ea1d-4bf0-8a33-07d02c1fe6c6", Scope: ScopeGlobal},
+		{Pattern: BotPattern, Scope: ScopeGlobal},
+		{Pattern: "deploy-*", Scope: ScopeUserbase},
+		{Pattern: "deploy-bot", Include: true, Scope: ScopeRoom},
+	}
+
+	require.NotNil(t, ExcludeSender(rules, "557058:48faede9-ea1d-4bf0-8a33-07d02c1fe6c6", false))
+	require.Equal(t, BotPattern, ExcludeSender(rules, "U123", true).Pattern)
+	require.Equal(t, "deploy-*", ExcludeSender(rules, "deploy-runner", false).Pattern)
+	require.Nil(t, ExcludeSender(rules, "U123", false))
+
+	// Room override includes the sender excluded for the userbase and as a bot
+	require.Nil(t, ExcludeSender(rules, "deploy-bot", true))
+}
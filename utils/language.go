@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Languages of messages as ISO 639-1 codes
+const (
+	LangEnglish    = "en"
+	LangSpanish    = "es"
+	LangFrench     = "fr"
+	LangGerman     = "de"
+	LangPortuguese = "pt"
+	LangItalian    = "it"
+	LangDutch      = "nl"
+)
+
+// Stop words of the languages with keyword extraction, English keywords are extracted by prose
+var languageStopWords = map[string]map[string]bool{
+	LangEnglish:    englishStopWords,
+	LangSpanish:    spanishStopWords,
+	LangFrench:     frenchStopWords,
+	LangGerman:     germanStopWords,
+	LangPortuguese: portugueseStopWords,
+	LangItalian:    italianStopWords,
+	LangDutch:      dutchStopWords,
+}
+
+// Languages told apart by script alone, none of them has keyword extraction
+var scriptLanguages = []struct {
+	script *unicode.RangeTable
+	lang   string
+}{
+	{unicode.Hangul, "ko"},
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Han, "zh"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Greek, "el"},
+	{unicode.Devanagari, "hi"},
+	{unicode.Thai, "th"},
+}
+
+// Words as in the vocabulary of the languages, elisions like c'est kept whole
+var languageWordRx = regexp.MustCompile(`[\p{L}\p{N}][\p{L}\p{N}'’_-]*`)
+
+// SupportedLanguage reports if keywords are extracted from messages in the language
+func SupportedLanguage(lang string) bool {
+	_, ok := languageStopWords[lang]
+	return ok
+}
+
+// DetectLanguage guesses the language of a message from its script and, for Latin script, its stop words.
+// Messages without evidence of another language are taken as English.
+func DetectLanguage(msg string) string {
+	var letters, latin int
+	counts := make(map[string]int)
+	for _, r := range msg {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+			continue
+		}
+		for _, s := range scriptLanguages {
+			if unicode.Is(s.script, r) {
+				counts[s.lang]++
+				break
+			}
+		}
+	}
+
+	// Japanese mixes Kanji with kana, any kana tells it from Chinese
+	if counts["ja"] > 0 && counts["zh"] > 0 {
+		counts["ja"] += counts["zh"]
+	}
+
+	if 2*latin < letters {
+		lang, best := "", 0
+		for _, s := range scriptLanguages {
+			if counts[s.lang] > best {
+				lang, best = s.lang, counts[s.lang]
+			}
+		}
+		if len(lang) > 0 {
+			return lang
+		}
+	}
+
+	scores := make(map[string]int)
+	for _, w := range languageWordRx.FindAllString(strings.ToLower(msg), -1) {
+		for lang, stopWords := range languageStopWords {
+			if stopWords[w] {
+				scores[lang]++
+			}
+		}
+	}
+
+	// English wins ties, short technical messages share few stop words with any language
+	lang := LangEnglish
+	for _, l := range []string{LangSpanish, LangFrench, LangGerman, LangPortuguese, LangItalian, LangDutch} {
+		if scores[l] > scores[lang] {
+			lang = l
+		}
+	}
+
+	return lang
+}
+
+// languageKeywords counts the words of a message which are not stop words of the language
+func languageKeywords(msg, lang string) map[string]int {
+	stopWords := languageStopWords[lang]
+
+	keywords := make(map[string]int)
+	for _, w := range languageWordRx.FindAllString(strings.ToLower(msg), -1) {
+		if !stopWords[w] && len([]rune(w)) > 1 && !isNumber(w) {
+			keywords[w]++
+		}
+	}
+
+	return keywords
+}
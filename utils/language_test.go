@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	langs := map[string]string{
+		"the deploy failed because of the cluster split":          LangEnglish,
+		"el despliegue falló por la partición del clúster":        LangSpanish,
+		"le déploiement a échoué à cause de la partition":         LangFrench,
+		"das Deployment ist wegen der Partition fehlgeschlagen":   LangGerman,
+		"o deploy falhou por causa da partição do cluster":        LangPortuguese,
+		"il rilascio non è andato a buon fine per la partizione":  LangItalian,
+		"de uitrol is mislukt door een splitsing van het cluster": LangDutch,
+		"gocql timeout": LangEnglish,
+		"デプロイが失敗しました":   "ja",
+		"部署失败了":         "zh",
+		"배포가 실패했습니다":    "ko",
+		"развертывание не удалось из-за разделения кластера": "ru",
+	}
+
+	for msg, lang := range langs {
+		require.Equal(t, lang, DetectLanguage(msg), msg)
+	}
+}
+
+func TestIndexLanguage(t *testing.T) {
+	d := Index("el #despliegue de la base de datos falló otra vez por la partición de la red y la base", IndexOptions{Pct: 0.2})
+	require.Equal(t, LangSpanish, d.Lang)
+	require.Contains(t, d.Tags, NormalizeTerm("despliegue"))
+	require.Contains(t, d.Keywords, "base")
+	for _, k := range d.Keywords {
+		require.False(t, spanishStopWords[k], k)
+	}
+
+	// Hash tags only for unsupported languages
+	d = Index("#deploy デプロイが失敗しました", IndexOptions{Pct: 0.5})
+	require.Equal(t, "ja", d.Lang)
+	require.Equal(t, []string{"deploy"}, d.Tags)
+	require.Empty(t, d.Keywords)
+}
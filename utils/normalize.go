@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Latin letters with diacritics folded to their base letters
+var foldMap = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ğ': "g", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'į': "i", 'ı': "i",
+	'ł': "l", 'ñ': "n", 'ń': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o",
+	'ř': "r", 'ś': "s", 'š': "s", 'ş': "s", 'ť': "t", 'ţ': "t",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'þ': "th", 'ð': "d",
+}
+
+// Fold lower cases the word and strips diacritics from Latin letters
+func Fold(w string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(w) {
+		if f, ok := foldMap[r]; ok {
+			b.WriteString(f)
+		} else if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// Stem strips common English inflectional and derivational suffixes.
+// It is deliberately conservative, short words are left alone to avoid conflating unrelated words.
+func Stem(w string) string {
+	if len(w) <= 3 || !isAlpha(w) {
+		return w
+	}
+
+	// Plurals
+	switch {
+	case strings.HasSuffix(w, "sses"):
+		w = w[:len(w)-2]
+	case strings.HasSuffix(w, "ies") && len(w) > 4:
+		w = w[:len(w)-3] + "y"
+	case strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss") && !strings.HasSuffix(w, "us") && !strings.HasSuffix(w, "is"):
+		w = w[:len(w)-1]
+	}
+
+	// Derivations and verb forms
+	switch {
+	case strings.HasSuffix(w, "ment") && len(w) >= 8:
+		w = w[:len(w)-4]
+	case strings.HasSuffix(w, "ing") && len(w) >= 7 && hasVowel(w[:len(w)-3]):
+		w = undouble(w[:len(w)-3])
+	case strings.HasSuffix(w, "ed") && len(w) >= 6 && hasVowel(w[:len(w)-2]):
+		w = undouble(w[:len(w)-2])
+	}
+
+	// Silent e, so that release, releases and released agree
+	if strings.HasSuffix(w, "e") && len(w) > 4 {
+		w = w[:len(w)-1]
+	}
+
+	return w
+}
+
+func isAlpha(w string) bool {
+	for _, r := range w {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func hasVowel(w string) bool {
+	return strings.ContainsAny(w, "aeiouy")
+}
+
+// undouble reduces a trailing double consonant left by suffix removal: stopped -> stop
+func undouble(w string) string {
+	n := len(w)
+	if n > 2 && w[n-1] == w[n-2] && !strings.ContainsRune("aeiouylsz", rune(w[n-1])) {
+		return w[:n-1]
+	}
+
+	return w
+}
+
+// SplitTag splits a hash tag into words at camelCase, kebab-case and snake_case boundaries
+func SplitTag(tag string) []string {
+	var parts []string
+	var cur []rune
+
+	flush := func() {
+		if len(cur) > 0 {
+			parts = append(parts, string(cur))
+			cur = nil
+		}
+	}
+
+	runes := []rune(tag)
+	for i, r := range runes {
+		switch {
+		case r == '-' || r == '_' || r == '.' || r == '/':
+			flush()
+			continue
+		case unicode.IsUpper(r) && i > 0:
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+
+			// deployFail and HTTPServer
+			if unicode.IsLower(prev) || (unicode.IsUpper(prev) && nextLower) {
+				flush()
+			}
+		}
+		cur = append(cur, r)
+	}
+	flush()
+
+	return parts
+}
+
+// NormalizeTerm folds and stems a single word
+func NormalizeTerm(w string) string {
+	return Stem(Fold(w))
+}
+
+// NormalizeTag returns the canonical form of a hash tag followed by its normalized words if it has many.
+// The canonical form is used for queries while all the forms are indexed.
+func NormalizeTag(tag string) []string {
+	parts := SplitTag(tag)
+	if len(parts) == 0 {
+		return nil
+	}
+
+	for i, p := range parts {
+		parts[i] = NormalizeTerm(p)
+	}
+
+	if len(parts) == 1 {
+		return parts
+	}
+
+	return append([]string{strings.Join(parts, "-")}, parts...)
+}
+
+// NormalizePhrase normalizes every word of a phrase
+func NormalizePhrase(p string) string {
+	words := strings.Fields(p)
+	for i, w := range words {
+		words[i] = NormalizeTerm(w)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// Aliases maps normalized alias terms to their normalized canonical term
+type Aliases map[string]string
+
+// Resolve returns the canonical term for an alias, the term itself otherwise
+func (a Aliases) Resolve(term string) string {
+	if c, ok := a[term]; ok {
+		return c
+	}
+
+	return term
+}
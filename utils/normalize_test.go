@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStem(t *testing.T) {
+	for _, w := range []string{"deploy", "deploys", "deployment", "deployments", "deploying", "deployed"} {
+		require.Equal(t, "deploy", Stem(w), w)
+	}
+
+	require.Equal(t, Stem("release"), Stem("released"))
+	require.Equal(t, Stem("release"), Stem("releases"))
+	require.Equal(t, "stop", Stem("stopped"))
+	require.Equal(t, "policy", Stem("policies"))
+	require.Equal(t, "status", Stem("status"))
+	require.Equal(t, "k8s", Stem("k8s"))
+}
+
+func TestNormalizeTag(t *testing.T) {
+	require.Equal(t, []string{"deploy-fail", "deploy", "fail"}, NormalizeTag("Deploy-Fail"))
+	require.Equal(t, []string{"deploy-fail", "deploy", "fail"}, NormalizeTag("deployFailed"))
+	require.Equal(t, []string{"http-server", "http", "server"}, NormalizeTag("HTTPServer"))
+	require.Equal(t, []string{"deploy"}, NormalizeTag("Deployments"))
+	require.Equal(t, []string{"cafe"}, NormalizeTag("Café"))
+}
+
+func TestNormalizeIndexQuery(t *testing.T) {
+	d := Index("rollout of #Deploy-Fail on #k8s cluster", IndexOptions{Pct: 0.1, Aliases: Aliases{"k8s": "kubernet"}})
+	require.Contains(t, d.Tags, "deploy-fail")
+	require.Contains(t, d.Tags, "deploy")
+	require.Contains(t, d.Tags, "k8s")
+	require.Contains(t, d.Tags, "kubernet")
+
+	_, tags := ExtractQueryTags("#Deploy-Fail #deployments #Kubernetes")
+	require.Equal(t, []string{"deploy-fail", "deploy", "kubernet"}, tags)
+}
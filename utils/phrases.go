@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Longest noun phrase retained, longer runs keep the trailing head words
+const maxPhraseWords = 3
+
+// Words and individual punctuation marks
+var phraseTokenRx = regexp.MustCompile(`[\p{L}\p{N}][\p{L}\p{N}'_-]*|[^\s\p{L}\p{N}]|\n`)
+
+// Double quoted phrases in search queries
+var queryPhraseRx = regexp.MustCompile(`"([^"]*)"`)
+
+type phraseToken struct {
+	text          string
+	lower         string
+	word          bool
+	capitalized   bool
+	sentenceStart bool
+}
+
+func phraseTokens(msg string) []phraseToken {
+	var tokens []phraseToken
+
+	start := true
+	for _, t := range phraseTokenRx.FindAllString(msg, -1) {
+		r := []rune(t)
+		word := unicode.IsLetter(r[0]) || unicode.IsDigit(r[0])
+		tokens = append(tokens, phraseToken{t, strings.ToLower(t), word, unicode.IsUpper(r[0]), start && word})
+
+		if word {
+			start = false
+		} else if strings.ContainsAny(t, ".!?\n") {
+			start = true
+		}
+	}
+
+	return tokens
+}
+
+// ExtractPhrases returns noun phrases and named entities in the message, lower cased without repeats.
+//
+// The perceptron tagger in prose/tag would be the natural tool for this, but its model weights
+// are not part of the vendored release, so the Treebank chunks are approximated from word shape:
+//   - named entities are runs of capitalized words, optionally linked as in "Bank of England"
+//   - noun phrases are runs of lower case content words introduced by a determiner or preposition,
+//     or repeated in the message
+func ExtractPhrases(msg string) []string {
+	tokens := phraseTokens(msg)
+
+	var phrases []string
+	var seen = make(map[string]bool)
+	add := func(words []string) {
+		p := strings.Join(words, " ")
+		if !seen[p] {
+			seen[p] = true
+			phrases = append(phrases, p)
+		}
+	}
+
+	for _, e := range namedEntities(tokens) {
+		add(e)
+	}
+
+	var runs [][]string
+	var counts = make(map[string]int)
+	for _, r := range contentRuns(tokens) {
+		counts[strings.Join(r.words, " ")]++
+		if r.introduced {
+			runs = append(runs, r.words)
+		}
+	}
+	for _, r := range contentRuns(tokens) {
+		if !r.introduced && counts[strings.Join(r.words, " ")] > 1 {
+			runs = append(runs, r.words)
+		}
+	}
+
+	for _, r := range runs {
+		add(r)
+	}
+
+	return phrases
+}
+
+func namedEntities(tokens []phraseToken) [][]string {
+	var entities [][]string
+	var cur []string
+	var caps int
+
+	flush := func() {
+		// Trailing connectors do not belong to the name
+		for len(cur) > 0 && entityConnectors[cur[len(cur)-1]] {
+			cur = cur[:len(cur)-1]
+		}
+		if caps > 1 {
+			entities = append(entities, cur)
+		}
+		cur, caps = nil, 0
+	}
+
+	for _, t := range tokens {
+		switch {
+		// Capitalized function words start sentences, they do not start names
+		case t.word && t.capitalized && !(t.sentenceStart && englishStopWords[t.lower]):
+			cur = append(cur, t.lower)
+			caps++
+		case t.word && len(cur) > 0 && entityConnectors[t.lower]:
+			cur = append(cur, t.lower)
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	return entities
+}
+
+type contentRun struct {
+	words      []string
+	introduced bool
+}
+
+func contentRuns(tokens []phraseToken) []contentRun {
+	var runs []contentRun
+	var cur []string
+	var introduced, prevMarker bool
+
+	flush := func() {
+		if len(cur) > 1 {
+			if len(cur) > maxPhraseWords {
+				cur = cur[len(cur)-maxPhraseWords:]
+			}
+			runs = append(runs, contentRun{cur, introduced})
+		}
+		cur = nil
+	}
+
+	for _, t := range tokens {
+		content := t.word && !t.capitalized && !englishStopWords[t.lower] && len(t.lower) > 1 && !isNumber(t.lower)
+		if content {
+			if len(cur) == 0 {
+				introduced = prevMarker
+			}
+			cur = append(cur, t.lower)
+		} else {
+			flush()
+		}
+
+		prevMarker = t.word && englishPhraseMarkers[t.lower]
+	}
+	flush()
+
+	return runs
+}
+
+func isNumber(w string) bool {
+	for _, r := range w {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ExtractQueryPhrases splits double quoted phrases out of the search query
+func ExtractQueryPhrases(msg string) (string, []string) {
+	var phrases []string
+	for _, m := range queryPhraseRx.FindAllStringSubmatch(msg, -1) {
+		if p := strings.Join(strings.Fields(strings.ToLower(m[1])), " "); len(p) > 0 {
+			phrases = append(phrases, p)
+		}
+	}
+
+	return queryPhraseRx.ReplaceAllString(msg, " "), phrases
+}
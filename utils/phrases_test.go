@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractPhrases(t *testing.T) {
+	const msg = `
+	during the cluster split, gocql query takes too long and opened the circuit (because of circuit timeout)
+	The Bank of England moved the Kafka Connect cluster to Google Cloud.
+	`
+
+	phrases := ExtractPhrases(msg)
+	require.Contains(t, phrases, "cluster split")
+	require.Contains(t, phrases, "circuit timeout")
+	require.Contains(t, phrases, "bank of england")
+	require.Contains(t, phrases, "kafka connect")
+	require.Contains(t, phrases, "google cloud")
+	require.NotContains(t, phrases, "gocql query takes")
+	require.NotContains(t, phrases, "the bank of england")
+}
+
+func TestExtractQueryPhrases(t *testing.T) {
+	_, tags := ExtractQueryTags(`"Circuit   Breaker" + gocql`)
+	require.Contains(t, tags, "circuit breaker")
+	require.Contains(t, tags, "gocql")
+}
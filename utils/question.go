@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"strings"
+)
+
+// Words opening English questions that are often asked without a question mark.
+// Words opening commands as often as questions, like do and have, are left out.
+var questionOpeners = map[string]bool{
+	"how": true, "why": true, "what": true, "where": true, "when": true, "who": true, "which": true,
+	"is": true, "are": true, "does": true, "did": true, "can": true, "could": true, "should": true, "would": true,
+	"anyone": true, "anybody": true,
+}
+
+// IsQuestion reports if a message looks like a question, by a question mark or an opening interrogative word.
+// Links and code are ignored as their question marks are not of the message.
+func IsQuestion(msg string) bool {
+	msg, _ = ExtractArtifacts(msg)
+
+	if strings.ContainsAny(msg, "?¿؟？") {
+		return true
+	}
+
+	// Mentions and tags often open the message
+	words := strings.Fields(msg)
+	for len(words) > 0 && strings.IndexAny(words[0], "@#<") == 0 {
+		words = words[1:]
+	}
+
+	return len(words) > 2 && questionOpeners[strings.Trim(strings.ToLower(words[0]), ",:")]
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsQuestion(t *testing.T) {
+	questions := map[string]bool{
+		"why does gocql time out on the write path?":               true,
+		"@here how do we rotate the cassandra credentials":         true,
+		"#gocql anyone seen timeouts after the upgrade":            true,
+		"¿alguien sabe por qué falla el despliegue":                true,
+		"deploy is done, see https://ci.acme.com/build?id=42":      false,
+		"do not deploy today":                                      false,
+		"the cluster split again":                                  false,
+		"what":                                                     false,
+		"fixed with `if err != nil { return x ? y : z }` in gocql": false,
+	}
+
+	for msg, question := range questions {
+		require.Equal(t, question, IsQuestion(msg), msg)
+	}
+}
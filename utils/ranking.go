@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Ranking weighs the parts of the score of a search result:
+//
+//	score = (1 + tag × tag matches + keyword × keyword matches) × 0.5^(age / halflife) + reactions × ln(1 + reactions)
+//
+// Terms matching both a tag and a keyword of a message count as tag matches only.
+type Ranking struct {
+	// Weight of query terms matching the hash tags of the message or its thread
+	Tag float64
+
+	// Weight of query terms matching the enrichment keywords and entities only
+	Keyword float64
+
+	// Days for the score to halve with the age of the message, no decay if 0
+	HalfLife float64
+
+	// Weight of the log of the number of reactions to the message
+	Reactions float64
+}
+
+// DefaultRanking ranks explicitly tagged messages above enriched ones, halving the score every month
+var DefaultRanking = Ranking{Tag: 3, Keyword: 1, HalfLife: 30, Reactions: 0.5}
+
+// ParseRanking overrides the weights of base with a spec like "tag=3,keyword=1,halflife=30,reactions=0.5"
+func ParseRanking(spec string, base Ranking) (Ranking, error) {
+	r := base
+	for _, kv := range strings.FieldsFunc(spec, func(c rune) bool { return c == ',' || c == ' ' }) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return base, fmt.Errorf("invalid ranking weight %s", kv)
+		}
+
+		v, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+			return base, fmt.Errorf("invalid ranking weight %s", kv)
+		}
+
+		switch strings.ToLower(parts[0]) {
+		case "tag":
+			r.Tag = v
+		case "keyword":
+			r.Keyword = v
+		case "halflife":
+			r.HalfLife = v
+		case "reactions":
+			r.Reactions = v
+		default:
+			return base, fmt.Errorf("unknown ranking weight %s", parts[0])
+		}
+	}
+
+	return r, nil
+}
+
+func (r Ranking) String() string {
+	return fmt.Sprintf("tag=%g,keyword=%g,halflife=%g,reactions=%g", r.Tag, r.Keyword, r.HalfLife, r.Reactions)
+}
+
+// Decay is the factor applied to the relevance of a message of the given age in days
+func (r Ranking) Decay(ageDays float64) float64 {
+	if r.HalfLife <= 0 || ageDays <= 0 {
+		return 1
+	}
+
+	return math.Pow(0.5, ageDays/r.HalfLife)
+}
+
+// Score computes the score of a search result, search orders by the same formula in SQL
+func (r Ranking) Score(tagMatches, keywordMatches int, ageDays float64, reactions int) float64 {
+	relevance := 1 + r.Tag*float64(tagMatches) + r.Keyword*float64(keywordMatches)
+	return relevance*r.Decay(ageDays) + r.Reactions*math.Log1p(float64(reactions))
+}
+
+// Explain details the parts of the score of a search result
+func (r Ranking) Explain(tagMatches, keywordMatches int, ageDays float64, reactions int) string {
+	return fmt.Sprintf("score %.2f = (1 + %g×%d tags + %g×%d keywords) × %.2f for %.1f days + %g×ln(1+%d reactions)",
+		r.Score(tagMatches, keywordMatches, ageDays, reactions), r.Tag, tagMatches, r.Keyword, keywordMatches,
+		r.Decay(ageDays), ageDays, r.Reactions, reactions)
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRanking(t *testing.T) {
+	r, err := ParseRanking("tag=5, halflife=0", DefaultRanking)
+	require.NoError(t, err)
+	require.Equal(t, Ranking{Tag: 5, Keyword: 1, HalfLife: 0, Reactions: 0.5}, r)
+
+	r, err = ParseRanking("", DefaultRanking)
+	require.NoError(t, err)
+	require.Equal(t, DefaultRanking, r)
+
+	for _, spec := range []string{"tag", "tag=-1", "tag=x", "tag=NaN", "keyword=Inf", "boost=2"} {
+		r, err = ParseRanking(spec, DefaultRanking)
+		require.Error(t, err, spec)
+		require.Equal(t, DefaultRanking, r)
+	}
+
+	r, err = ParseRanking(DefaultRanking.String(), Ranking{})
+	require.NoError(t, err)
+	require.Equal(t, DefaultRanking, r)
+}
+
+func TestRankingScore(t *testing.T) {
+	r := DefaultRanking
+
+	// Explicit tags with all the terms win over a loose keyword match of the same age
+	require.True(t, r.Score(2, 0, 10, 0) > r.Score(0, 1, 10, 0))
+	require.True(t, r.Score(0, 2, 10, 0) > r.Score(0, 1, 10, 0))
+
+	// Older matches lose to fresh ones, halving every half life
+	require.InDelta(t, r.Score(1, 0, 0, 0)/2, r.Score(1, 0, 30, 0), 1e-9)
+	require.InDelta(t, 4.0, Ranking{Tag: 3}.Score(1, 0, 365, 0), 1e-9)
+
+	// Reactions help popular messages
+	require.True(t, r.Score(1, 0, 10, 5) > r.Score(1, 0, 10, 0))
+
+	require.Contains(t, r.Explain(1, 2, 30, 0), "score 3.00 = (1 + 3×1 tags + 1×2 keywords) × 0.50")
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Words of a message as matched against search terms, dotted words like domains kept whole
+var snippetWordRx = regexp.MustCompile(`[\p{L}\p{N}](?:[\p{L}\p{N}_'.-]*[\p{L}\p{N}])?`)
+
+var whitespaceRx = regexp.MustCompile(`\s+`)
+
+// Marks the cut ends of a snippet
+const ellipsis = "…"
+
+// Snippet returns the part of the message around the first word matching the search terms, of about length runes
+// with whitespace collapsed. Matching words are passed through mark. A length of 0 keeps the whole message.
+func Snippet(msg string, terms []string, length int, mark func(string) string) string {
+	msg = strings.TrimSpace(whitespaceRx.ReplaceAllString(msg, " "))
+
+	// Phrases and compound tags match by their words
+	words := make(map[string]bool)
+	for _, t := range terms {
+		words[t] = true
+		for _, w := range strings.FieldsFunc(t, func(r rune) bool { return r == ' ' || r == '-' }) {
+			words[w] = true
+		}
+	}
+
+	locs := snippetWordRx.FindAllStringIndex(msg, -1)
+	var matches [][]int
+	for _, l := range locs {
+		if snippetWordMatches(msg[l[0]:l[1]], words) {
+			matches = append(matches, l)
+		}
+	}
+
+	start, end := 0, len(msg)
+	if runes := []rune(msg); length > 0 && len(runes) > length {
+		// Center the window on the first match, in runes
+		center := 0
+		if len(matches) > 0 {
+			center = len([]rune(msg[:matches[0][0]]))
+		}
+
+		from := center - length/2
+		if from < 0 {
+			from = 0
+		}
+		to := from + length
+		if to > len(runes) {
+			to = len(runes)
+			from = to - length
+		}
+
+		start, end = len(string(runes[:from])), len(string(runes[:to]))
+
+		// Do not cut words in half
+		for _, l := range locs {
+			if l[0] < start && start < l[1] {
+				start = l[1]
+			}
+			if l[0] < end && end < l[1] {
+				end = l[0]
+			}
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString(ellipsis)
+	}
+
+	pos := start
+	for _, m := range matches {
+		if m[0] < start || m[1] > end {
+			continue
+		}
+		b.WriteString(msg[pos:m[0]])
+		b.WriteString(mark(msg[m[0]:m[1]]))
+		pos = m[1]
+	}
+	b.WriteString(msg[pos:end])
+
+	if end < len(msg) {
+		b.WriteString(ellipsis)
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+func snippetWordMatches(w string, words map[string]bool) bool {
+	if strings.Contains(w, ".") {
+		return words[strings.TrimPrefix(Fold(w), "www.")]
+	}
+
+	for _, t := range NormalizeTag(w) {
+		if words[t] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RelativeTime describes how long before now the time was, dates are given past a month
+func RelativeTime(t, now time.Time) string {
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d/time.Minute))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d/time.Hour))
+	case d < 30*24*time.Hour:
+		return fmt.Sprintf("%dd ago", int(d/(24*time.Hour)))
+	}
+
+	return t.Format("2006-01-02")
+}
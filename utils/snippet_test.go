@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnippet(t *testing.T) {
+	bold := func(w string) string { return "*" + w + "*" }
+
+	msg := strings.Repeat("lorem ipsum dolor ", 20) + "the #Deployments to\ngithub.com failed " + strings.Repeat("sit amet ", 20)
+	s := Snippet(msg, []string{"deploy", "github.com"}, 60, bold)
+	require.Contains(t, s, "#*Deployments*")
+	require.Contains(t, s, "*github.com*")
+	require.True(t, strings.HasPrefix(s, ellipsis))
+	require.True(t, strings.HasSuffix(s, ellipsis))
+	require.NotContains(t, s, "\n")
+	require.True(t, len([]rune(s)) <= 62, s)
+
+	// Short messages are kept whole
+	require.Equal(t, "*circuit* *breaker* opened", Snippet("circuit  breaker opened", []string{"circuit breaker"}, 60, bold))
+	require.Equal(t, "no match here", Snippet("no match here", []string{"deploy"}, 0, bold))
+}
+
+func TestRelativeTime(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	require.Equal(t, "just now", RelativeTime(now.Add(-10*time.Second), now))
+	require.Equal(t, "5m ago", RelativeTime(now.Add(-5*time.Minute), now))
+	require.Equal(t, "3h ago", RelativeTime(now.Add(-3*time.Hour), now))
+	require.Equal(t, "2d ago", RelativeTime(now.Add(-49*time.Hour), now))
+	require.Equal(t, "2018-03-01", RelativeTime(time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC), now))
+}
@@ -0,0 +1,75 @@
+package utils
+
+// Function words which do not carry meaning on their own
+var englishStopWords = toSet(
+	"a", "about", "above", "after", "again", "against", "all", "also", "am", "an", "and", "any", "are", "as", "at",
+	"be", "because", "been", "before", "being", "below", "between", "both", "but", "by",
+	"can", "could", "did", "do", "does", "doing", "down", "during", "each", "even", "few", "for", "from", "further",
+	"had", "has", "have", "having", "he", "her", "here", "hers", "herself", "him", "himself", "his", "how",
+	"i", "if", "in", "into", "is", "it", "its", "itself", "just", "let", "like", "may", "me", "might", "more", "most", "must", "my", "myself",
+	"no", "nor", "not", "now", "of", "off", "on", "once", "only", "or", "other", "our", "ours", "ourselves", "out", "over", "own",
+	"same", "she", "should", "so", "some", "such", "than", "that", "the", "their", "theirs", "them", "themselves", "then", "there",
+	"these", "they", "this", "those", "through", "to", "too", "under", "until", "up", "us", "very",
+	"was", "we", "were", "what", "when", "where", "which", "while", "who", "whom", "why", "will", "with", "would",
+	"yes", "yet", "you", "your", "yours", "yourself", "yourselves",
+)
+
+// Words introducing a noun phrase
+var englishPhraseMarkers = toSet(
+	"a", "an", "the", "this", "that", "these", "those", "my", "our", "your", "their", "his", "her", "its",
+	"some", "any", "no", "each", "every", "of", "in", "on", "at", "for", "with", "during", "about", "from",
+	"to", "by", "into", "after", "before", "over", "under", "between",
+)
+
+// Words linking the parts of a name like "Bank of England"
+var entityConnectors = toSet("of", "and", "&", "de", "la", "van", "von", "der")
+
+func toSet(words ...string) map[string]bool {
+	set := make(map[string]bool, len(words))
+	for _, w := range words {
+		set[w] = true
+	}
+
+	return set
+}
+
+// Function words of the other languages with keyword extraction, also used to detect the language of a message
+var spanishStopWords = toSet(
+	"a", "al", "algo", "como", "con", "cuando", "de", "del", "desde", "donde", "el", "ella", "ellos", "en", "entre", "era", "es",
+	"esta", "estaba", "este", "esto", "estos", "fue", "ha", "hay", "la", "las", "le", "les", "lo", "los", "mas", "más", "me", "mi",
+	"muy", "no", "nos", "o", "para", "pero", "por", "porque", "que", "qué", "se", "si", "sí", "sin", "sobre", "son", "su", "sus",
+	"también", "te", "tiene", "todo", "un", "una", "uno", "y", "ya", "yo",
+)
+
+var frenchStopWords = toSet(
+	"a", "à", "au", "aux", "avec", "ce", "ces", "cette", "dans", "de", "des", "du", "elle", "en", "est", "et", "être", "il", "ils",
+	"je", "la", "le", "les", "leur", "lui", "mais", "me", "même", "mes", "moi", "mon", "ne", "nous", "on", "ou", "où", "par",
+	"pas", "plus", "pour", "qu", "que", "qui", "sa", "se", "ses", "son", "sont", "sur", "ta", "te", "tes", "toi", "ton", "tu",
+	"un", "une", "vos", "votre", "vous", "y", "été", "c'est", "j'ai",
+)
+
+var germanStopWords = toSet(
+	"aber", "als", "am", "an", "auch", "auf", "aus", "bei", "bin", "bis", "da", "das", "dass", "dem", "den", "der", "des", "die",
+	"doch", "du", "ein", "eine", "einem", "einen", "einer", "es", "für", "hat", "hatte", "ich", "ihr", "im", "in", "ist", "ja",
+	"kein", "keine", "mit", "nach", "nicht", "noch", "nur", "oder", "schon", "sein", "sich", "sie", "sind", "so", "um", "und",
+	"uns", "von", "vor", "war", "was", "wenn", "wie", "wir", "wird", "zu", "zum", "zur", "über",
+)
+
+var portugueseStopWords = toSet(
+	"a", "ao", "aos", "as", "com", "como", "da", "das", "de", "do", "dos", "e", "é", "ela", "ele", "eles", "em", "entre", "era",
+	"essa", "esse", "esta", "este", "eu", "foi", "há", "isso", "isto", "já", "mais", "mas", "me", "meu", "minha", "muito", "na",
+	"não", "nas", "no", "nos", "num", "numa", "o", "os", "ou", "para", "pela", "pelo", "por", "que", "se", "sem", "seu", "sua",
+	"são", "também", "um", "uma", "você",
+)
+
+var italianStopWords = toSet(
+	"a", "al", "alla", "anche", "che", "chi", "ci", "come", "con", "da", "dal", "dei", "del", "della", "di", "e", "è", "gli",
+	"ha", "ho", "i", "il", "in", "io", "la", "le", "lo", "ma", "mi", "nel", "nella", "non", "o", "per", "più", "perché", "quando",
+	"questa", "questo", "se", "si", "sono", "su", "sua", "suo", "tra", "tu", "un", "una", "uno",
+)
+
+var dutchStopWords = toSet(
+	"aan", "al", "als", "bij", "dat", "de", "die", "dit", "door", "een", "en", "er", "had", "heb", "heeft", "het", "hij", "hoe",
+	"ik", "in", "is", "je", "kan", "maar", "me", "met", "mij", "niet", "nog", "nu", "of", "om", "ook", "op", "over", "te", "tot",
+	"uit", "van", "voor", "was", "wat", "we", "wel", "wij", "worden", "wordt", "zal", "ze", "zij", "zijn", "zo",
+)
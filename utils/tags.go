@@ -1,7 +1,7 @@
 package utils
 
 import (
-	"fmt"
+	"math"
 	"regexp"
 	"sort"
 	"strings"
@@ -10,10 +10,10 @@ import (
 	"github.com/jdkato/prose/tokenize"
 )
 
-// Custom type to sort keywords in a message based on frequence
+// Custom type to sort keywords in a message based on weight
 type keyword struct {
-	word string
-	freq int
+	word   string
+	weight float64
 }
 type keywordArray []keyword
 
@@ -26,40 +26,120 @@ func (s keywordArray) Swap(i, j int) {
 }
 
 func (s keywordArray) Less(i, j int) bool {
-	return s[i].freq > s[j].freq
+	if s[i].weight == s[j].weight {
+		return s[i].word < s[j].word
+	}
+	return s[i].weight > s[j].weight
+}
+
+// Corpus provides document frequencies of terms in the set of messages indexed so far
+type Corpus interface {
+	Docs() int
+	DocFreqs(terms []string) map[string]int
 }
 
-var ignoreQueryTagsFilterRegex, ignoreIndexTagsFilterRegex *regexp.Regexp
+// TermStats is an in-memory Corpus
+type TermStats struct {
+	NumDocs int
+	DF      map[string]int
+}
 
-func init() {
-	// Map of suffix and prefix since we break them at tokenize
-	var ignoreQueryWords = []string{
-		"@search",
-		"@ignore",
-		"@silent",
-		"@quiet",
-		"@find",
-		"@register",
-		"@botler",
+func (t *TermStats) Docs() int {
+	return t.NumDocs
+}
+
+func (t *TermStats) DocFreqs(terms []string) map[string]int {
+	df := make(map[string]int)
+	for _, term := range terms {
+		if v, ok := t.DF[term]; ok {
+			df[term] = v
+		}
 	}
 
-	var ignoreIndexWords []string = append(ignoreQueryWords, []string{
-		"@all",
-		"@here",
-	}...)
+	return df
+}
+
+// Add accounts the terms of a document
+func (t *TermStats) Add(terms map[string]int) {
+	if t.DF == nil {
+		t.DF = make(map[string]int)
+	}
 
-	ignoreQueryTagsFilterRegex = regexp.MustCompile(fmt.Sprintf("(%s)", strings.Join(ignoreQueryWords, "|")))
-	ignoreIndexTagsFilterRegex = regexp.MustCompile(fmt.Sprintf("(%s)", strings.Join(ignoreIndexWords, "|")))
+	t.NumDocs++
+	for term := range terms {
+		t.DF[term]++
+	}
 }
 
+// IndexOptions controls tag extraction and enrichment of a message
+type IndexOptions struct {
+	// Minimum ratio of tags to words, keywords enrich messages below it
+	Pct float64
+
+	// Minimum number of words in a message without tags
+	MinWords int
+
+	// Index messages without hash tags
+	DisableHashCheck bool
+
+	// Rank enrichment keywords by TF-IDF against the corpus instead of frequency in the message
+	Corpus Corpus
+
+	// Canonical terms indexed along with their aliases
+	Aliases Aliases
+
+	// Ignore and opt-out words, DefaultVocabulary if nil
+	Vocabulary *Vocabulary
+}
+
+// IndexData is the outcome of tag extraction on a message
+type IndexData struct {
+	Tags     []string
+	Keywords []string
+
+	// Noun phrases and named entities
+	Entities []string
+
+	// Candidate keywords with their frequency in the message, used to maintain the Corpus
+	Terms map[string]int
+
+	// URLs, ticket keys and the kinds of artifacts in the message
+	Links   []string
+	Tickets []string
+	Has     []string
+
+	// Detected language of the message
+	Lang string
+
+	// Message has an opt-out word
+	OptedOut bool
+}
+
+// ExtractIndexTags returns the hash tags and enrichment keywords ranked by frequency in the message
 func ExtractIndexTags(msg string, pct float64, minWords int, disableHashCheck bool) ([]string, []string) {
+	d := Index(msg, IndexOptions{Pct: pct, MinWords: minWords, DisableHashCheck: disableHashCheck})
+	return d.Tags, d.Keywords
+}
+
+// Index extracts the hash tags and enrichment keywords of a message
+func Index(msg string, opts IndexOptions) *IndexData {
+	v := opts.Vocabulary
+	if v == nil {
+		v = DefaultVocabulary()
+	}
+
 	// Check if message is to be ignored
-	if ignoreIndexTagsFilterRegex.MatchString(msg) {
-		return nil, nil
+	if v.OptsOut(msg) {
+		return &IndexData{OptedOut: true}
 	}
 
 	// Strip out the ignore words from the query input
-	msg = ignoreQueryTagsFilterRegex.ReplaceAllString(msg, "")
+	msg = v.Strip(msg)
+
+	// Links, code and stack traces are not words of the message
+	msg, artifacts := ExtractArtifacts(msg)
+
+	lang := DetectLanguage(msg)
 
 	doc := summarize.NewDocument(msg)
 	words := tokenize.NewTreebankWordTokenizer().Tokenize(doc.Content)
@@ -68,32 +148,69 @@ func ExtractIndexTags(msg string, pct float64, minWords int, disableHashCheck bo
 	var prevWord string
 	var tagMap = make(map[string]byte)
 
+	addTag := func(t string) {
+		if _, ok := tagMap[t]; !ok {
+			tags = append(tags, t)
+			tagMap[t] = 1
+		}
+	}
+
 	for _, w := range words {
 		// Store the hash tagMap and @ mentions by ignoring repeats
 		if (prevWord == "#" || prevWord == "@") && w != prevWord {
-			lw := strings.ToLower(w)
-			tags = append(tags, lw)
-			tagMap[lw] = 1
+			for _, t := range NormalizeTag(w) {
+				addTag(t)
+				addTag(opts.Aliases.Resolve(t))
+			}
 		}
 
 		prevWord = w
 	}
 
 	// Check if we have sufficient index data to index the message
-	if len(tagMap) == 0 && (!disableHashCheck || (minWords > 0 && len(words) < minWords)) {
-		return nil, nil
+	if len(tagMap) == 0 && (!opts.DisableHashCheck || (opts.MinWords > 0 && len(words) < opts.MinWords)) {
+		return &IndexData{Lang: lang}
+	}
+
+	data := &IndexData{
+		Links:   artifacts.Links,
+		Tickets: artifacts.Tickets,
+		Has:     artifacts.Has(),
+		Lang:    lang,
+	}
+
+	// Without stop words for the language keywords would be noise, the message is indexed by its hash tags only
+	if !SupportedLanguage(lang) {
+		for _, d := range artifacts.Domains {
+			addTag(d)
+		}
+		data.Tags = tags
+		return data
+	}
+
+	// prose filters English stop words only
+	counts := doc.Keywords()
+	if lang != LangEnglish {
+		counts = languageKeywords(msg, lang)
+	}
+
+	// Inflections of a word count as the same term
+	terms := make(map[string]int)
+	for k, v := range counts {
+		terms[NormalizeTerm(k)] += v
 	}
 
 	// Check if we have sufficient keywords with round-off to search this message or enrich it
-	moreTags := int(0.5 + (pct*doc.NumWords - float64(len(tagMap))))
+	moreTags := int(0.5 + (opts.Pct*doc.NumWords - float64(len(tagMap))))
 	if moreTags > 0 {
-		var kw keywordArray
-		for k, v := range doc.Keywords() {
-			lw := strings.ToLower(k)
-			if _, ok := tagMap[lw]; !ok {
-				kw = append(kw, keyword{lw, v})
+		var candidates []string
+		for k := range terms {
+			if _, ok := tagMap[k]; !ok {
+				candidates = append(candidates, k)
 			}
 		}
+
+		kw := rankKeywords(candidates, terms, opts.Corpus)
 		sort.Sort(kw)
 
 		for _, w := range kw {
@@ -102,22 +219,188 @@ func ExtractIndexTags(msg string, pct float64, minWords int, disableHashCheck bo
 			}
 
 			keywords = append(keywords, w.word)
+			if c := opts.Aliases.Resolve(w.word); c != w.word {
+				keywords = append(keywords, c)
+			}
+		}
+	}
+
+	// Phrase heuristics rely on English function words
+	var entities []string
+	if lang == LangEnglish {
+		for _, e := range ExtractPhrases(msg) {
+			entities = append(entities, NormalizePhrase(e))
+		}
+	}
+
+	// Linked sites are searchable by domain
+	for _, d := range artifacts.Domains {
+		addTag(d)
+	}
+
+	data.Tags, data.Keywords, data.Entities, data.Terms = tags, keywords, entities, terms
+	return data
+}
+
+// rankKeywords weighs candidates by frequency in the message, scaled by smoothed inverse document frequency with a corpus
+func rankKeywords(candidates []string, tf map[string]int, corpus Corpus) keywordArray {
+	var kw keywordArray
+
+	if corpus == nil || corpus.Docs() == 0 {
+		for _, w := range candidates {
+			kw = append(kw, keyword{w, float64(tf[w])})
 		}
+		return kw
 	}
 
-	return tags, keywords
+	df := corpus.DocFreqs(candidates)
+	for _, w := range candidates {
+		kw = append(kw, keyword{w, float64(tf[w]) * idf(corpus.Docs(), df[w])})
+	}
+
+	return kw
+}
+
+// idf is the smoothed inverse document frequency of a term found in df of n documents
+func idf(n, df int) float64 {
+	return math.Log((1+float64(n))/(1+float64(df))) + 1
 }
 
-// QueryTags parses the search query and returns the operation type and search words
+// RarityWeights weighs terms by inverse document frequency in the corpus, terms rare in the corpus weigh more.
+// Without a corpus all terms weigh 1.
+func RarityWeights(terms []string, corpus Corpus) map[string]float64 {
+	weights := make(map[string]float64)
+	if corpus == nil || corpus.Docs() == 0 {
+		for _, t := range terms {
+			weights[t] = 1
+		}
+		return weights
+	}
+
+	df := corpus.DocFreqs(terms)
+	for _, t := range terms {
+		weights[t] = idf(corpus.Docs(), df[t])
+	}
+
+	return weights
+}
+
+// Words in search queries, hash tags keep their inner separators to be normalized as a whole.
+// Dotted words like domains are kept whole.
+var queryWordRx = regexp.MustCompile(`[\p{L}\p{N}][\p{L}\p{N}_-]*(\.[\p{L}\p{N}][\p{L}\p{N}_-]*)*`)
+
+// Filters in search queries: has:link, has:code, has:trace, has:ticket and ticket:ABC-123
+var queryFilterRx = regexp.MustCompile(`(?i)\b(has|ticket):(\S+)`)
+
+// Query is a parsed search query
+type Query struct {
+	// '+' to match all tags
+	Op   byte
+	Tags []string
+
+	// Kinds of artifacts the messages must have
+	Has []string
+
+	// Ticket keys the messages must refer to any of
+	Tickets []string
+}
+
+// Empty reports if the query has neither terms nor filters
+func (q *Query) Empty() bool {
+	return len(q.Tags) == 0 && len(q.Has) == 0 && len(q.Tickets) == 0
+}
+
+// Match reports if an indexed message matches the query as search would
+func (q *Query) Match(d *IndexData) bool {
+	if q.Empty() {
+		return false
+	}
+
+	terms := toSet(d.Tags...)
+	for _, t := range append(d.Keywords, d.Entities...) {
+		terms[t] = true
+	}
+
+	var matched int
+	for _, t := range q.Tags {
+		if terms[t] {
+			matched++
+		}
+	}
+	if len(q.Tags) > 0 && (matched == 0 || (q.Op == '+' && matched < len(q.Tags))) {
+		return false
+	}
+
+	has := toSet(d.Has...)
+	for _, h := range q.Has {
+		if !has[h] {
+			return false
+		}
+	}
+
+	if len(q.Tickets) == 0 {
+		return true
+	}
+	tickets := toSet(d.Tickets...)
+	for _, t := range q.Tickets {
+		if tickets[t] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// QueryTags parses the search query and returns the operation type and search words normalized as at index time
 func ExtractQueryTags(msg string) (byte, []string) {
-	var queryOp byte
+	return ExtractQueryTagsWithVocabulary(msg, DefaultVocabulary())
+}
+
+// ExtractQueryTagsWithVocabulary is ExtractQueryTags stripping the ignore words of given vocabulary
+func ExtractQueryTagsWithVocabulary(msg string, v *Vocabulary) (byte, []string) {
+	q := ParseQuery(msg, v)
+	return q.Op, q.Tags
+}
+
+// ParseQuery parses the search query stripping the ignore words of given vocabulary
+func ParseQuery(msg string, v *Vocabulary) *Query {
+	q := &Query{}
 
 	// Check for query operator
 	if strings.ContainsAny(msg, "+&") {
-		queryOp = '+'
+		q.Op = '+'
 	}
 
 	// Strip out the ignore words from the query input
-	msg = ignoreQueryTagsFilterRegex.ReplaceAllString(msg, "")
-	return queryOp, tokenize.NewWordBoundaryTokenizer().Tokenize(msg)
+	msg = v.Strip(msg)
+
+	msg = queryFilterRx.ReplaceAllStringFunc(msg, func(m string) string {
+		f := queryFilterRx.FindStringSubmatch(m)
+		switch strings.ToLower(f[1]) {
+		case "has":
+			switch kind := strings.ToLower(f[2]); kind {
+			case HasLink, HasCode, HasTrace, HasTicket:
+				q.Has = append(q.Has, kind)
+			}
+		case "ticket":
+			q.Tickets = append(q.Tickets, strings.ToUpper(f[2]))
+		}
+		return " "
+	})
+
+	// Quoted phrases match entities as a whole
+	msg, phrases := ExtractQueryPhrases(msg)
+
+	for _, w := range queryWordRx.FindAllString(msg, -1) {
+		if strings.Contains(w, ".") {
+			q.Tags = append(q.Tags, strings.TrimPrefix(Fold(w), "www."))
+		} else if t := NormalizeTag(w); len(t) > 0 {
+			q.Tags = append(q.Tags, t[0])
+		}
+	}
+	for _, p := range phrases {
+		q.Tags = append(q.Tags, NormalizePhrase(p))
+	}
+
+	return q
 }
@@ -33,3 +33,52 @@ func TestExtractQueryTags(t *testing.T) {
 	require.NotEmpty(t, tags)
 	require.NotContains(t, tags, "@quiet")
 }
+
+func TestIndexCorpus(t *testing.T) {
+	const msg = `gocql gocql gocql timeout during the cluster split, the circuit breaker opened before gocql returned #imp`
+
+	d := Index(msg, IndexOptions{Pct: 0.1})
+	require.Equal(t, "gocql", d.Keywords[0])
+	require.Equal(t, 4, d.Terms["gocql"])
+
+	// gocql shows up in every message of the room and is no longer distinctive
+	corpus := &TermStats{}
+	for i := 0; i < 20; i++ {
+		corpus.Add(map[string]int{"gocql": 1, "cassandra": 1})
+	}
+
+	d = Index(msg, IndexOptions{Pct: 0.1, Corpus: corpus})
+	require.NotEqual(t, "gocql", d.Keywords[0])
+}
+
+func TestRarityWeights(t *testing.T) {
+	require.Equal(t, map[string]float64{"gocql": 1, "split": 1}, RarityWeights([]string{"gocql", "split"}, nil))
+
+	corpus := &TermStats{}
+	for i := 0; i < 20; i++ {
+		corpus.Add(map[string]int{"gocql": 1})
+	}
+	corpus.Add(map[string]int{"split": 1})
+
+	w := RarityWeights([]string{"gocql", "split", "brain"}, corpus)
+	require.True(t, w["split"] > w["gocql"])
+	require.True(t, w["brain"] > w["split"])
+	require.InDelta(t, 1.0, w["gocql"], 0.1)
+}
+
+func TestVocabulary(t *testing.T) {
+	const msg = "#deploy of the searchlight service @searchlight"
+
+	// Ignore words match whole words only
+	tags, _ := ExtractIndexTags(msg, 0.05, 0, false)
+	require.Contains(t, tags, "deploy")
+
+	tags, _ = ExtractIndexTags(msg+" @search,", 0.05, 0, false)
+	require.Empty(t, tags)
+
+	v := DefaultVocabulary()
+	v.AddOptOut("@standup")
+	v.Allow("@here")
+	require.Empty(t, Index(msg+" @standup", IndexOptions{Vocabulary: v}).Tags)
+	require.NotEmpty(t, Index(msg+" @here", IndexOptions{Vocabulary: v}).Tags)
+}
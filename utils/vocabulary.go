@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Vocabulary holds the words controlling indexing of a message.
+// Ignore words are stripped from messages and queries, opt-out words prevent a message from being indexed.
+type Vocabulary struct {
+	Ignore map[string]bool
+	OptOut map[string]bool
+}
+
+// Bot commands addressed in the message, they are not part of the content
+var defaultIgnoreWords = []string{
+	"@search",
+	"@ignore",
+	"@silent",
+	"@quiet",
+	"@find",
+	"@register",
+	"@botler",
+}
+
+// Broadcast mentions are not worth indexing
+var defaultOptOutWords = []string{
+	"@all",
+	"@here",
+}
+
+// Whitespace separated tokens of a message
+var vocabularyTokenRx = regexp.MustCompile(`\S+`)
+
+// DefaultVocabulary returns the vocabulary used unless configured otherwise.
+// Messages addressing the bot commands are not indexed either.
+func DefaultVocabulary() *Vocabulary {
+	v := &Vocabulary{Ignore: toSet(defaultIgnoreWords...), OptOut: toSet(defaultIgnoreWords...)}
+	for _, w := range defaultOptOutWords {
+		v.OptOut[w] = true
+	}
+
+	return v
+}
+
+// AddIgnore strips the word from messages and queries
+func (v *Vocabulary) AddIgnore(w string) {
+	v.Ignore[strings.ToLower(w)] = true
+}
+
+// AddOptOut prevents messages with the word from being indexed
+func (v *Vocabulary) AddOptOut(w string) {
+	v.OptOut[strings.ToLower(w)] = true
+}
+
+// Allow removes the word from ignore and opt-out lists
+func (v *Vocabulary) Allow(w string) {
+	delete(v.Ignore, strings.ToLower(w))
+	delete(v.OptOut, strings.ToLower(w))
+}
+
+// vocabularyWord trims punctuation following the word: "@search," matches "@search"
+func vocabularyWord(token string) string {
+	return strings.ToLower(strings.TrimRight(token, ".,;:!?)]}'\""))
+}
+
+// OptsOut reports if any token of the message is an opt-out word
+func (v *Vocabulary) OptsOut(msg string) bool {
+	for _, t := range vocabularyTokenRx.FindAllString(msg, -1) {
+		if v.OptOut[vocabularyWord(t)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Strip removes the tokens of the message which are ignore words
+func (v *Vocabulary) Strip(msg string) string {
+	return vocabularyTokenRx.ReplaceAllStringFunc(msg, func(t string) string {
+		if v.Ignore[vocabularyWord(t)] {
+			return ""
+		}
+		return t
+	})
+}